@@ -1,10 +1,9 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io"
 	"math"
@@ -12,20 +11,38 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
 )
 
 const (
-	landscapeRatioWidth  = 16
-	landscapeRatioHeight = 9
-	portraitRatioWidth   = 9
-	portraitRatioHeight  = 16
-	landscape            = "16:9"
-	portrait             = "9:16"
-	other                = "other"
+	landscape = "16:9"
+	portrait  = "9:16"
+	standard  = "4:3"
+	square    = "1:1"
+	ultrawide = "21:9"
+	vertical  = "4:5"
+	other     = "other"
 )
 
+// knownAspectRatios are the shapes calcAspectRatio recognises, with how far off
+// a video's width/height ratio may be. "21:9" is a marketing name covering
+// everything from 2.33 (2560x1080 is 2.37) to the 2.39 of cinemascope.
+var knownAspectRatios = []struct {
+	name          string
+	width, height float64
+	tolerance     float64
+}{
+	{landscape, 16, 9, 0.01},
+	{portrait, 9, 16, 0.01},
+	{standard, 4, 3, 0.01},
+	{square, 1, 1, 0.01},
+	{ultrawide, 2.365, 1, 0.035},
+	{vertical, 4, 5, 0.01},
+}
+
 func detectFileMediaType(file multipart.File) (string, error) {
 	// Conventionally, the first 512 bytes of a file are used to determine the file type
 	const sniffLen = 512
@@ -57,9 +74,13 @@ func (cfg apiConfig) ensureAssetsDir() error {
 }
 
 func mediaTypeToExt(mediaType string) (string, error) {
-	// Speacial case for MP4 files since exts[0] for "video/mp4" will be ".m4v"
-	if mediaType == "video/mp4" {
-		return ".mp4", nil
+	// Speacial case for video files since exts[0] for "video/mp4" will be ".m4v",
+	// and not every system knows about Matroska
+	if ext, ok := uploadVideoTypes[mediaType]; ok {
+		return ext, nil
+	}
+	if mediaType == captionMediaType {
+		return ".vtt", nil
 	}
 
 	exts, err := mime.ExtensionsByType(mediaType)
@@ -89,16 +110,10 @@ func getAssetPath(mediaType string) (string, error) {
 	return fmt.Sprintf("%s%s", randomFileName, ext), nil
 }
 
-func (cfg apiConfig) getAssetDiskPath(assetPath string) string {
-	return filepath.Join(cfg.assetsRoot, assetPath)
-}
-
-func (cfg apiConfig) getAssetURL(assetPath string) string {
-	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, assetPath)
-}
-
-func (cfg apiConfig) getObjectURL(key string) string {
-	return fmt.Sprintf("%s/%s", cfg.s3CfDistribution, key)
+// derivedKeyPrefix is where objects generated from the object at key (renditions,
+// resized images, ...) are stored, so they can be found and deleted with it.
+func derivedKeyPrefix(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "/"
 }
 
 func getObjectKeyPrefix(aspectRatio string) string {
@@ -107,60 +122,39 @@ func getObjectKeyPrefix(aspectRatio string) string {
 		return "landscape"
 	case portrait:
 		return "portrait"
+	case standard:
+		return "standard"
+	case square:
+		return "square"
+	case ultrawide:
+		return "ultrawide"
+	case vertical:
+		return "vertical"
 	default:
 		return other
 	}
 }
 
-func getVideoAspectRatio(filePath string) (string, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("ffprobe error: %w", err)
-	}
-
-	var output struct {
-		Streams []struct {
-			Width  int `json:"width"`
-			Height int `json:"height"`
-		} `json:"streams"`
-	}
-	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
-		return "", fmt.Errorf("error parsing ffprobe output: %w", err)
-	}
-	if len(output.Streams) == 0 {
-		return "", fmt.Errorf("no video streams found in ffprobe output")
-	}
-
-	aspectRatio := calcAspectRatio(output.Streams[0].Width, output.Streams[0].Height)
-	return aspectRatio, nil
-}
-
 func calcAspectRatio(width int, height int) string {
-	const tolerance = 0.01
+	if width <= 0 || height <= 0 {
+		return other
+	}
 	ratio := float64(width) / float64(height)
-	landscapeRatio := float64(landscapeRatioWidth) / float64(landscapeRatioHeight)
-	portraitRatio := float64(portraitRatioWidth) / float64(portraitRatioHeight)
 
-	if math.Abs(ratio-landscapeRatio) < tolerance {
-		return landscape
-	}
-	if math.Abs(ratio-portraitRatio) < tolerance {
-		return portrait
+	for _, known := range knownAspectRatios {
+		if math.Abs(ratio-known.width/known.height) < known.tolerance {
+			return known.name
+		}
 	}
 
 	return other
 }
 
-func processVideoForFastStart(filePath string) (string, error) {
+func (cfg *apiConfig) processVideoForFastStart(ctx context.Context, filePath string, progress media.Progress) (string, error) {
 	outputFilePath := filePath + ".processing"
 
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputFilePath)
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("ffmpeg error: %w", err)
+	if err := cfg.media.FastStart(ctx, filePath, outputFilePath, progress); err != nil {
+		return "", err
 	}
 
 	return outputFilePath, nil
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// The true peak is EBU R128's maximum, the loudness range loudnorm's default.
+const (
+	loudnormTruePeak = -1.0
+	loudnormRange    = 7.0
+	// loudnorm works at 192 kHz, which is far more than AAC needs
+	loudnormSampleRate = 48000
+)
+
+// audioRenditionExts are the AUDIO_RENDITION formats and their file extensions.
+var audioRenditionExts = map[string]string{
+	"aac": ".m4a",
+	"mp3": ".mp3",
+}
+
+// measureLoudness measures the sound of the video at filePath, returning nil for
+// videos without any.
+func (cfg *apiConfig) measureLoudness(ctx context.Context, filePath string, probe media.Probe, progress media.Progress) (*media.Loudness, error) {
+	if !probe.HasAudio {
+		return nil, nil
+	}
+	loudness, err := cfg.media.MeasureLoudness(ctx, filePath, progress)
+	if err != nil {
+		return nil, fmt.Errorf("error measuring loudness: %w", err)
+	}
+	return &loudness, nil
+}
+
+// optimizeForPlayback does the fast start processing of a video. When enabled, the
+// same pass normalizes its loudness, re-encoding the audio, and burns in watermark,
+// re-encoding the video. Silence can't be normalized, so is left as it is.
+func (cfg *apiConfig) optimizeForPlayback(ctx context.Context, filePath string, loudness *media.Loudness, watermark *media.Watermark, progress media.Progress) (string, error) {
+	normalize := cfg.loudnormEnabled && loudness != nil && !math.IsInf(loudness.Integrated, 0)
+	if !normalize && watermark == nil {
+		return cfg.processVideoForFastStart(ctx, filePath, progress)
+	}
+
+	outputFilePath := filePath + ".processing"
+	opts := media.TranscodeOptions{VideoCodec: "copy", FastStart: true}
+	if loudness != nil {
+		opts.AudioCodec = "copy"
+	}
+	if normalize {
+		encodeAAC(&opts)
+		opts.AudioFilter = loudnormFilter(cfg.loudnormTarget, *loudness)
+	}
+	if watermark != nil {
+		encodeH264(&opts)
+		opts.Watermark = watermark
+	}
+	if err := cfg.media.Transcode(ctx, filePath, outputFilePath, opts, progress); err != nil {
+		return "", fmt.Errorf("error optimizing video: %w", err)
+	}
+	return outputFilePath, nil
+}
+
+// loudnormFilter is the second, linear pass of loudnorm, which scales the whole
+// track by one gain based on the first pass's measurement rather than compressing it.
+func loudnormFilter(target int, measured media.Loudness) string {
+	return fmt.Sprintf("loudnorm=I=%d:TP=%.1f:LRA=%.1f:measured_I=%.2f:measured_TP=%.2f:measured_LRA=%.2f:measured_thresh=%.2f:linear=true,aresample=%d",
+		target, loudnormTruePeak, loudnormRange,
+		measured.Integrated, measured.TruePeak, measured.Range, measured.Threshold,
+		loudnormSampleRate)
+}
+
+// publishAudio stores an audio-only rendition of the video at filePath next to
+// objKey and fills in its URL on outputs. AAC copies the video's audio as it is.
+func (cfg *apiConfig) publishAudio(ctx context.Context, filePath, objKey string, probe media.Probe, outputs *database.VideoOutputs, progress *processingProgress) error {
+	ext, ok := audioRenditionExts[cfg.audioRendition]
+	if !ok || !probe.HasAudio {
+		return nil
+	}
+
+	outputFilePath := filePath + ".audio" + ext
+	opts := media.TranscodeOptions{AudioCodec: "copy", FastStart: true}
+	if cfg.audioRendition == "mp3" {
+		opts = media.TranscodeOptions{AudioCodec: "libmp3lame", AudioBitrate: "192k"}
+	}
+	if err := cfg.media.Transcode(ctx, filePath, outputFilePath, opts, progress.step("extracting audio", probe.DurationSeconds)); err != nil {
+		return fmt.Errorf("error extracting audio: %w", err)
+	}
+	defer os.Remove(outputFilePath)
+
+	f, err := os.Open(outputFilePath)
+	if err != nil {
+		return fmt.Errorf("error reading audio rendition: %w", err)
+	}
+	defer f.Close()
+
+	key := derivedKeyPrefix(objKey) + "audio" + ext
+	if err := cfg.videoStore.Put(ctx, key, f, streamingContentType(outputFilePath)); err != nil {
+		return fmt.Errorf("error uploading audio rendition: %w", err)
+	}
+	audioURL := cfg.videoStore.URL(key)
+	outputs.AudioURL = &audioURL
+	return nil
+}
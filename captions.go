@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	captionMediaType    = "text/vtt"
+	captionsUploadLimit = 2 << 20 // 2 MB
+)
+
+var errInvalidCaptions = errors.New("invalid captions")
+
+// captionsKeyPrefix is where a video's caption tracks are stored in the video store.
+// They're keyed by video rather than kept under derivedKeyPrefix of the video object:
+// tracks can be added before anything is uploaded, and they outlive the object, whose
+// derived prefix is deleted whenever a re-upload, trim or reprocess replaces it.
+func captionsKeyPrefix(videoID uuid.UUID) string {
+	return path.Join("captions", videoID.String())
+}
+
+var languageTagPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// normalizeLanguageTag checks tag looks like a BCP 47 language tag and returns it
+// in its conventional case, e.g. "pt-BR" for "PT-br", so each language has one track.
+func normalizeLanguageTag(tag string) (string, bool) {
+	if !languageTagPattern.MatchString(tag) {
+		return "", false
+	}
+	parts := strings.Split(tag, "-")
+	parts[0] = strings.ToLower(parts[0])
+	for i, part := range parts[1:] {
+		switch {
+		case len(part) == 4 && isLetters(part): // script, e.g. "Hant"
+			part = strings.ToUpper(part[:1]) + strings.ToLower(part[1:])
+		case len(part) == 2 && isLetters(part), len(part) == 3 && !isLetters(part): // region, e.g. "BR" or "419"
+			part = strings.ToUpper(part)
+		default:
+			part = strings.ToLower(part)
+		}
+		parts[i+1] = part
+	}
+	return strings.Join(parts, "-"), true
+}
+
+func isLetters(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// toWebVTT returns WebVTT captions as they are and converts SubRip (SRT) ones,
+// which browsers can't play. The error wraps errInvalidCaptions when data is neither.
+func toWebVTT(data []byte) ([]byte, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("%w: not UTF-8 text", errInvalidCaptions)
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	if rest, ok := strings.CutPrefix(text, "WEBVTT"); ok {
+		if rest != "" && rest[0] != ' ' && rest[0] != '\t' && rest[0] != '\n' {
+			return nil, fmt.Errorf("%w: malformed WEBVTT header", errInvalidCaptions)
+		}
+		return []byte(text), nil
+	}
+	return srtToWebVTT(text)
+}
+
+var (
+	srtCueSeparator  = regexp.MustCompile(`\n\s*\n`)
+	srtTimingPattern = regexp.MustCompile(`^\s*(\d{1,2}:\d{2}:\d{2}[,.]\d{1,3})\s*-->\s*(\d{1,2}:\d{2}:\d{2}[,.]\d{1,3})`)
+	// WebVTT has no <font>, players show the tags as text
+	srtFontTagPattern = regexp.MustCompile(`(?i)</?font[^>]*>`)
+)
+
+// srtToWebVTT converts SubRip cues. SRT positioning is dropped, as WebVTT positions
+// cues differently, and so is <font> styling.
+func srtToWebVTT(text string) ([]byte, error) {
+	var out bytes.Buffer
+	out.WriteString("WEBVTT\n")
+
+	cues := 0
+	for i, block := range srtCueSeparator.Split(strings.TrimSpace(text), -1) {
+		lines := strings.Split(block, "\n")
+		// The cue number is optional in practice
+		if len(lines) > 1 && !strings.Contains(lines[0], "-->") {
+			lines = lines[1:]
+		}
+
+		match := srtTimingPattern.FindStringSubmatch(lines[0])
+		if match == nil {
+			return nil, fmt.Errorf("%w: cue %d has no valid timing line", errInvalidCaptions, i+1)
+		}
+
+		cueText := []string{}
+		for _, line := range lines[1:] {
+			line = srtFontTagPattern.ReplaceAllString(line, "")
+			// "-->" would be read as a timing line
+			line = strings.ReplaceAll(line, "-->", "--&gt;")
+			if strings.TrimSpace(line) != "" {
+				cueText = append(cueText, line)
+			}
+		}
+		if len(cueText) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&out, "\n%s --> %s\n%s\n", vttTimestamp(match[1]), vttTimestamp(match[2]), strings.Join(cueText, "\n"))
+		cues++
+	}
+	if cues == 0 {
+		return nil, fmt.Errorf("%w: no cues", errInvalidCaptions)
+	}
+	return out.Bytes(), nil
+}
+
+// vttTimestamp turns an SRT timestamp like "1:02:03,4" into "01:02:03.400".
+func vttTimestamp(srt string) string {
+	clock, fraction, _ := strings.Cut(strings.Replace(srt, ",", ".", 1), ".")
+	if len(clock) < len("00:00:00") {
+		clock = "0" + clock
+	}
+	return clock + "." + fraction + strings.Repeat("0", 3-len(fraction))
+}
+
+var (
+	vttTimingPattern = regexp.MustCompile(`^((?:\d+:)?\d{2}:\d{2}\.\d{3})[ \t]+-->[ \t]+((?:\d+:)?\d{2}:\d{2}\.\d{3})(.*)$`)
+	// Timestamps inside cue text, as used for karaoke-style captions
+	vttInlineTimestampPattern = regexp.MustCompile(`<((?:\d+:)?\d{2}:\d{2}\.\d{3})>`)
+)
+
+// trimWebVTT retimes WebVTT captions for a cut of the video from start that lasts
+// length. Cues outside the cut are dropped and cues overlapping its ends are
+// shortened to fit. Cues with timings players couldn't read either are dropped too.
+func trimWebVTT(vtt []byte, start, length time.Duration) []byte {
+	shift := func(t time.Duration) time.Duration {
+		return min(max(t-start, 0), length)
+	}
+
+	blocks := srtCueSeparator.Split(strings.TrimSpace(string(vtt)), -1)
+	var out bytes.Buffer
+	// The header block, with any metadata headers
+	out.WriteString(blocks[0])
+	out.WriteString("\n")
+
+	for _, block := range blocks[1:] {
+		lines := strings.Split(block, "\n")
+		timing := slices.IndexFunc(lines, func(line string) bool { return strings.Contains(line, "-->") })
+		// NOTE, STYLE and REGION blocks don't depend on the timeline
+		if timing < 0 {
+			fmt.Fprintf(&out, "\n%s\n", block)
+			continue
+		}
+
+		match := vttTimingPattern.FindStringSubmatch(lines[timing])
+		if match == nil {
+			continue
+		}
+		cueStart, err1 := parseVTTTimestamp(match[1])
+		cueEnd, err2 := parseVTTTimestamp(match[2])
+		if err1 != nil || err2 != nil || cueEnd <= start || cueStart >= start+length {
+			continue
+		}
+		lines[timing] = formatVTTTimestamp(shift(cueStart)) + " --> " + formatVTTTimestamp(shift(cueEnd)) + match[3]
+		for i := timing + 1; i < len(lines); i++ {
+			lines[i] = vttInlineTimestampPattern.ReplaceAllStringFunc(lines[i], func(tag string) string {
+				t, err := parseVTTTimestamp(tag[1 : len(tag)-1])
+				if err != nil {
+					return tag
+				}
+				return "<" + formatVTTTimestamp(shift(t)) + ">"
+			})
+		}
+		fmt.Fprintf(&out, "\n%s\n", strings.Join(lines, "\n"))
+	}
+	return out.Bytes()
+}
+
+// parseVTTTimestamp parses a "[HH:]MM:SS.mmm" WebVTT timestamp.
+func parseVTTTimestamp(s string) (time.Duration, error) {
+	clock, millis, _ := strings.Cut(s, ".")
+	parts := strings.Split(clock, ":")
+	t := time.Duration(0)
+	for _, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		t = t*60 + time.Duration(value)
+	}
+	ms, err := strconv.Atoi(millis)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return t*time.Second + time.Duration(ms)*time.Millisecond, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrimWebVTT(t *testing.T) {
+	tests := []struct {
+		name          string
+		vtt           string
+		start, length time.Duration
+		want          string
+	}{
+		{
+			name:  "shifts cues inside the cut",
+			vtt:   "WEBVTT\n\n00:00:12.000 --> 00:00:14.500\nHello\n\n01:00:00.000 --> 01:00:01.000\nLater\n",
+			start: 10 * time.Second, length: time.Hour,
+			want: "WEBVTT\n\n00:00:02.000 --> 00:00:04.500\nHello\n\n00:59:50.000 --> 00:59:51.000\nLater\n",
+		},
+		{
+			name:  "drops cues outside the cut",
+			vtt:   "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nBefore\n\n00:00:05.000 --> 00:00:06.000\nInside\n\n00:00:20.000 --> 00:00:21.000\nAfter\n",
+			start: 4 * time.Second, length: 10 * time.Second,
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nInside\n",
+		},
+		{
+			name:  "clamps cues overlapping the ends",
+			vtt:   "WEBVTT\n\n00:00:03.000 --> 00:00:05.000\nStart\n\n00:00:13.000 --> 00:00:16.000\nEnd\n",
+			start: 4 * time.Second, length: 10 * time.Second,
+			want: "WEBVTT\n\n00:00:00.000 --> 00:00:01.000\nStart\n\n00:00:09.000 --> 00:00:10.000\nEnd\n",
+		},
+		{
+			name:  "keeps identifiers, settings and blocks without timings",
+			vtt:   "WEBVTT - Tubely\n\nNOTE made by hand\n\nintro\n00:00:05.000 --> 00:00:06.000 align:start line:0\nHi\n",
+			start: 5 * time.Second, length: 10 * time.Second,
+			want: "WEBVTT - Tubely\n\nNOTE made by hand\n\nintro\n00:00:00.000 --> 00:00:01.000 align:start line:0\nHi\n",
+		},
+		{
+			name:  "shifts inline timestamps",
+			vtt:   "WEBVTT\n\n00:00:05.000 --> 00:00:07.000\nOne <00:00:06.000>two\n",
+			start: 5 * time.Second, length: 10 * time.Second,
+			want: "WEBVTT\n\n00:00:00.000 --> 00:00:02.000\nOne <00:00:01.000>two\n",
+		},
+		{
+			name:  "drops cues with unreadable timings",
+			vtt:   "WEBVTT\n\n0:5 --> 0:6\nBroken\n\n00:06.000 --> 00:07.000\nShort form\n",
+			start: 5 * time.Second, length: 10 * time.Second,
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nShort form\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(trimWebVTT([]byte(tt.vtt), tt.start, tt.length))
+			if got != tt.want {
+				t.Errorf("trimWebVTT() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// Names of the object stores as recorded in queued deletions
+const (
+	videoStoreName = "video"
+	assetStoreName = "asset"
+)
+
+const (
+	deletionBatchSize  = 100
+	deletionMaxBackoff = time.Hour
+	// How long a claimed deletion is left to its runner before it's due again
+	deletionLease = 10 * time.Minute
+)
+
+func (cfg *apiConfig) storeByName(name string) (storage.ObjectStore, error) {
+	switch name {
+	case videoStoreName:
+		return cfg.videoStore, nil
+	case assetStoreName:
+		return cfg.assetStore, nil
+	}
+	return nil, fmt.Errorf("unknown object store %q", name)
+}
+
+// videoObjectRefs lists everything stored for a video: the video object, the thumbnail,
+// anything derived from them, its captions, its originals and any raw uploads still
+// waiting to be processed.
+func (cfg *apiConfig) videoObjectRefs(video database.Video) []database.ObjectRef {
+	refs := []database.ObjectRef{
+		{Store: videoStoreName, Key: incomingKeyPrefix(video.ID) + "/", IsPrefix: true},
+		{Store: videoStoreName, Key: captionsKeyPrefix(video.ID) + "/", IsPrefix: true},
+		{Store: videoStoreName, Key: originalsKeyPrefix(video.ID) + "/", IsPrefix: true},
+	}
+	return append(refs, cfg.videoPublishedRefs(video)...)
+}
+
+// videoPublishedRefs lists the objects a video's URLs point at, plus everything derived from them,
+// its current caption tracks and the original it was made from.
+func (cfg *apiConfig) videoPublishedRefs(video database.Video) []database.ObjectRef {
+	refs := []database.ObjectRef{}
+	if video.VideoURL != nil {
+		if key, ok := storage.KeyFromURL(cfg.videoStore, *video.VideoURL); ok {
+			refs = append(refs,
+				database.ObjectRef{Store: videoStoreName, Key: key},
+				database.ObjectRef{Store: videoStoreName, Key: derivedKeyPrefix(key), IsPrefix: true},
+			)
+		}
+	}
+	if video.ThumbnailURL != nil {
+		if key, ok := storage.KeyFromURL(cfg.assetStore, *video.ThumbnailURL); ok {
+			refs = append(refs,
+				database.ObjectRef{Store: assetStoreName, Key: key},
+				database.ObjectRef{Store: assetStoreName, Key: derivedKeyPrefix(key), IsPrefix: true},
+			)
+		}
+	}
+	if video.OriginalKey != nil {
+		refs = append(refs, database.ObjectRef{Store: videoStoreName, Key: *video.OriginalKey})
+	}
+	for _, track := range video.Captions {
+		if key, ok := storage.KeyFromURL(cfg.videoStore, track.URL); ok {
+			refs = append(refs, database.ObjectRef{Store: videoStoreName, Key: key})
+		}
+	}
+	return refs
+}
+
+// runObjectDeletions attempts each queued deletion once, skipping any another run
+// claimed first. Failures stay queued with a backoff and are picked up again by
+// retryObjectDeletions.
+func (cfg *apiConfig) runObjectDeletions(ctx context.Context, deletions []database.ObjectDeletion) {
+	for _, deletion := range deletions {
+		claimed, err := cfg.db.ClaimObjectDeletion(deletion.ID, deletionLease)
+		if err != nil {
+			log.Printf("Couldn't claim deletion of %q: %v", deletion.Key, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		err = cfg.deleteObjectRef(ctx, deletion.ObjectRef)
+		if err != nil {
+			log.Printf("Couldn't delete %s object %q (attempt %d): %v", deletion.Store, deletion.Key, deletion.Attempts+1, err)
+			nextAttemptAt := time.Now().Add(deletionBackoff(deletion.Attempts))
+			if err := cfg.db.FailObjectDeletion(deletion.ID, err.Error(), nextAttemptAt); err != nil {
+				log.Printf("Couldn't record failed deletion of %q: %v", deletion.Key, err)
+			}
+			continue
+		}
+		if err := cfg.db.CompleteObjectDeletion(deletion.ID); err != nil {
+			log.Printf("Couldn't mark deletion of %q complete: %v", deletion.Key, err)
+		}
+	}
+}
+
+func (cfg *apiConfig) deleteObjectRef(ctx context.Context, ref database.ObjectRef) error {
+	store, err := cfg.storeByName(ref.Store)
+	if err != nil {
+		return err
+	}
+	if !ref.IsPrefix {
+		return store.Delete(ctx, ref.Key)
+	}
+
+	objects, err := store.List(ctx, ref.Key)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := store.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryObjectDeletions periodically works through queued deletions until ctx is done.
+func (cfg *apiConfig) retryObjectDeletions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deletions, err := cfg.db.GetDueObjectDeletions(deletionBatchSize)
+		if err != nil {
+			log.Printf("Couldn't load queued deletions: %v", err)
+		} else {
+			cfg.runObjectDeletions(ctx, deletions)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func deletionBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second << min(attempts, 10)
+	return min(backoff, deletionMaxBackoff)
+}
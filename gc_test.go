@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestCollectGarbageKeepsQueuedUploads(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	token, video := newTestVideo(t, cfg)
+
+	if rec := uploadVideo(t, cfg, token, video.ID, "video/mp4", []byte("an mp4")); rec.Code != http.StatusAccepted {
+		t.Fatalf("Upload responded %d: %s", rec.Code, rec.Body)
+	}
+
+	// No grace period, so only references keep the queued upload alive
+	report, err := cfg.collectGarbage(context.Background(), gcOptions{})
+	if err != nil {
+		t.Fatalf("collectGarbage: %v", err)
+	}
+	if len(report.Orphans) != 0 {
+		t.Errorf("Orphans = %+v, want the queued upload kept", report.Orphans)
+	}
+
+	runNextJob(t, cfg)
+	if status := getVideo(t, cfg, video.ID).Status; status != database.VideoStatusReady {
+		t.Errorf("Status after processing = %q, want %q", status, database.VideoStatusReady)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// objectStoreHandler serves objects straight out of an ObjectStore. It is only
+// mounted for backends that have no web server of their own (e.g. memory).
+func objectStoreHandler(store storage.ObjectStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		if isPrivateKey(key) {
+			http.NotFound(w, r)
+			return
+		}
+		info, err := store.Head(r.Context(), key)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Couldn't read object", err)
+			return
+		}
+
+		body, err := store.Get(r.Context(), key)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't read object", err)
+			return
+		}
+		defer body.Close()
+
+		if info.ContentType != "" {
+			w.Header().Set("Content-Type", info.ContentType)
+		}
+		if seeker, ok := body.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, key, info.LastModified, seeker)
+			return
+		}
+		io.Copy(w, body)
+	})
+}
+
+// privateKeyPrefixes hold objects only the server itself reads: raw uploads and
+// the originals videos are reprocessed from.
+var privateKeyPrefixes = []string{"incoming/", "originals/"}
+
+func isPrivateKey(key string) bool {
+	key = strings.TrimPrefix(path.Clean("/"+key), "/")
+	for _, prefix := range privateKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hidePrivateObjects answers requests for private objects with a 404, for stores
+// served by a plain file server (e.g. local).
+func hidePrivateObjects(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPrivateKey(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// handlerQueueGet reports how busy video processing is, overall and for the caller.
+func (cfg *apiConfig) handlerQueueGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Jobs          database.JobQueueStats `json:"jobs"`
+		MaxQueuedJobs int                    `json:"max_queued_jobs"`
+		Workers       int                    `json:"workers"`
+		Media         media.LimiterStats     `json:"media"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	stats, err := cfg.db.GetJobQueueStats(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get queue stats", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Jobs:          stats,
+		MaxQueuedJobs: cfg.maxQueuedJobs,
+		Workers:       cfg.processingWorkers,
+		Media:         cfg.mediaLimiter.Stats(),
+	})
+}
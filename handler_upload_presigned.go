@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const presignedUploadExpiry = 15 * time.Minute
+
+// handlerPresignVideoUpload lets the browser upload a video straight to the bucket.
+// The client PUTs the file to the returned URL and then calls handlerCompleteVideoUpload.
+func (cfg *apiConfig) handlerPresignVideoUpload(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+	}
+	type response struct {
+		storage.PresignedRequest
+		Key string `json:"key"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return
+	}
+
+	presigner, ok := cfg.videoStore.(storage.Presigner)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads aren't supported by this storage backend", nil)
+		return
+	}
+
+	// The body is optional, older clients only ever uploaded MP4
+	params := parameters{ContentType: videoMediaType}
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&params); err != nil && !errors.Is(err, io.EOF) {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+			return
+		}
+	}
+	if !isUploadVideoType(params.ContentType) {
+		respondWithError(w, http.StatusBadRequest, "Invalid file type, only MP4, MOV, WebM and MKV are allowed", nil)
+		return
+	}
+
+	if err := cfg.checkQueueCapacity(); err != nil {
+		respondQueueFull(w, err)
+		return
+	}
+
+	objKey, err := incomingObjectKey(videoID, params.ContentType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not create object key", err)
+		return
+	}
+
+	if err := cfg.beginVideoUpload(videoID); err != nil {
+		if errors.Is(err, database.ErrInvalidStatusTransition) {
+			respondWithError(w, http.StatusConflict, "Video is still being processed", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video status", err)
+		return
+	}
+
+	presigned, err := presigner.PresignPut(r.Context(), objKey, params.ContentType, presignedUploadExpiry)
+	if err != nil {
+		cfg.abandonVideoUpload(video)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		PresignedRequest: presigned,
+		Key:              objKey,
+	})
+}
+
+// handlerCompleteVideoUpload queues a video the client uploaded with a presigned URL for processing.
+func (cfg *apiConfig) handlerCompleteVideoUpload(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key string `json:"key"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return
+	}
+
+	// Only accept keys we handed out for this video
+	if !strings.HasPrefix(params.Key, incomingKeyPrefix(videoID)+"/") || path.Clean(params.Key) != params.Key {
+		respondWithError(w, http.StatusBadRequest, "Invalid object key", nil)
+		return
+	}
+
+	info, err := cfg.videoStore.Head(r.Context(), params.Key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			respondWithError(w, http.StatusBadRequest, "Uploaded video not found", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check uploaded video", err)
+		return
+	}
+	if info.Size > videoUploadLimit {
+		cfg.videoStore.Delete(r.Context(), params.Key)
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Uploaded video is too large", nil)
+		return
+	}
+
+	// The upload stays in the bucket, so the client can simply complete it again later
+	if err := cfg.checkQueueCapacity(); err != nil {
+		respondQueueFull(w, err)
+		return
+	}
+
+	video, err = cfg.enqueueVideoProcessing(videoID, params.Key)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidStatusTransition) {
+			respondWithError(w, http.StatusConflict, "Video is already being processed", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Could not queue video for processing", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, video)
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"mime"
 	"net/http"
-	"os"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
 	"github.com/google/uuid"
 )
 
@@ -65,41 +66,42 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	assetPath, err := getAssetPath(mediaType)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get asset path", err)
-		return
-	}
-	assetDiskPath := cfg.getAssetDiskPath(assetPath)
-
-	dst, err := os.Create(assetDiskPath)
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create file on Server", err)
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
 		return
 	}
-	defer dst.Close()
-	if _, err := io.Copy(dst, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save file", err)
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	data, err := io.ReadAll(file)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		respondWithError(w, http.StatusBadRequest, "Unable to read file", err)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+
+	// The client is waiting, so this doesn't queue behind processing jobs
+	thumbnail, err := cfg.storeThumbnail(media.Interactive(r.Context()), data, mediaType)
+	if err != nil {
+		if errors.Is(err, errInvalidImage) {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode image", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save file", err)
 		return
 	}
 
-	thumbnailURL := cfg.getAssetURL(assetPath)
-	video.ThumbnailURL = &thumbnailURL
-
-	if err := cfg.db.UpdateVideo(video); err != nil {
+	if err := cfg.db.SetVideoThumbnail(videoID, thumbnail.URL, thumbnail.Srcset); err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	updated, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, updated)
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads implement the tus 1.0 protocol (https://tus.io/protocols/resumable-upload),
+// bound to a single video and its owner. Finished uploads are queued for the same processing as
+// POST /api/video_upload/{videoID}.
+
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(videoUploadLimit, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Length header", err)
+		return
+	}
+	if length > videoUploadLimit {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Upload is too large", nil)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata header", err)
+		return
+	}
+
+	// An upload that was let in is always processed, however full the queue is by then
+	if err := cfg.checkQueueCapacity(); err != nil {
+		respondQueueFull(w, err)
+		return
+	}
+
+	// Before the video is marked uploading, which an expired upload of it would undo
+	cfg.removeExpiredTusUploads()
+
+	if err := cfg.beginVideoUpload(videoID); err != nil {
+		if errors.Is(err, database.ErrInvalidStatusTransition) {
+			respondWithError(w, http.StatusConflict, "Video is still being processed", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video status", err)
+		return
+	}
+
+	upload, err := cfg.tusUploads.create(videoID, userID, length, metadata)
+	if err != nil {
+		cfg.abandonVideoUpload(video)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/video_upload/%s/tus/%s", videoID, upload.ID))
+	w.Header().Set("Upload-Expires", upload.expiresAt().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	upload, offset, ok := cfg.authorizeTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.expiresAt().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	upload, offset, ok := cfg.authorizeTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+
+	unlock, ok := cfg.tusUploads.lock(upload.ID)
+	if !ok {
+		respondWithError(w, http.StatusLocked, "Upload is already in progress", nil)
+		return
+	}
+	defer unlock()
+
+	// Re-read the offset now that we hold the lock
+	upload, offset, err := cfg.tusUploads.get(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find upload", err)
+		return
+	}
+
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Offset header", err)
+		return
+	}
+	if clientOffset != offset {
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the current offset", nil)
+		return
+	}
+	if r.ContentLength > upload.Length-offset {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length", nil)
+		return
+	}
+
+	offset, err = cfg.tusUploads.write(upload, offset, r.Body)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", upload.expiresAt().Format(http.TimeFormat))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write chunk", err)
+		return
+	}
+
+	// A PATCH with an empty body on a complete upload retries processing
+	if offset < upload.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := cfg.finishTusUpload(r, upload); err != nil {
+		if errors.Is(err, errUnsupportedVideoType) {
+			cfg.tusUploads.remove(upload.ID)
+			cfg.abandonTusUpload(upload)
+			respondWithError(w, http.StatusBadRequest, "File isn't a supported video", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Could not process video", err)
+		return
+	}
+	cfg.tusUploads.remove(upload.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusDelete(w http.ResponseWriter, r *http.Request) {
+	upload, _, ok := cfg.authorizeTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	unlock, ok := cfg.tusUploads.lock(upload.ID)
+	if !ok {
+		respondWithError(w, http.StatusLocked, "Upload is in progress", nil)
+		return
+	}
+	defer unlock()
+
+	cfg.tusUploads.remove(upload.ID)
+	cfg.abandonTusUpload(upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// abandonTusUpload takes the video of a removed upload out of uploading, unless
+// something else has moved it on already.
+func (cfg *apiConfig) abandonTusUpload(upload tusUpload) {
+	video, err := cfg.db.GetVideo(upload.VideoID)
+	if err == nil && video.Status == database.VideoStatusUploading {
+		cfg.abandonVideoUpload(video)
+	}
+}
+
+// removeExpiredTusUploads cleans up resumable uploads that were never finished.
+func (cfg *apiConfig) removeExpiredTusUploads() {
+	for _, upload := range cfg.tusUploads.removeExpired() {
+		cfg.abandonTusUpload(upload)
+	}
+}
+
+// finishTusUpload hands a complete upload over to background processing.
+func (cfg *apiConfig) finishTusUpload(r *http.Request, upload tusUpload) error {
+	file, err := os.Open(cfg.tusUploads.dataPath(upload.ID))
+	if err != nil {
+		return fmt.Errorf("error opening upload: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := cfg.validateUploadedVideo(media.WithOwner(r.Context(), upload.UserID.String()), file.Name()); err != nil {
+		return err
+	}
+
+	// tus clients conventionally send the file's type in the filetype metadata
+	mediaType := upload.Metadata["filetype"]
+	if !isUploadVideoType(mediaType) {
+		mediaType = videoMediaType
+	}
+
+	sourceKey, err := cfg.stageVideoUpload(r.Context(), upload.VideoID, file, mediaType)
+	if err != nil {
+		return err
+	}
+	if _, err := cfg.enqueueVideoProcessing(upload.VideoID, sourceKey); err != nil {
+		// Retrying the upload stages it again
+		cfg.deleteStagedUpload(r.Context(), sourceKey)
+		return err
+	}
+	return nil
+}
+
+// authorizeTusUpload loads the upload addressed by the request and checks it
+// belongs to the caller. It writes the error response itself when it returns false.
+func (cfg *apiConfig) authorizeTusUpload(w http.ResponseWriter, r *http.Request) (tusUpload, int64, bool) {
+	if !checkTusResumable(w, r) {
+		return tusUpload{}, 0, false
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return tusUpload{}, 0, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return tusUpload{}, 0, false
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return tusUpload{}, 0, false
+	}
+
+	upload, offset, err := cfg.tusUploads.get(r.PathValue("uploadID"))
+	if err != nil {
+		if errors.Is(err, errTusUploadNotFound) {
+			respondWithError(w, http.StatusNotFound, "Couldn't find upload", err)
+			return tusUpload{}, 0, false
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read upload", err)
+		return tusUpload{}, 0, false
+	}
+	if upload.VideoID != videoID {
+		respondWithError(w, http.StatusNotFound, "Couldn't find upload", nil)
+		return tusUpload{}, 0, false
+	}
+	if upload.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return tusUpload{}, 0, false
+	}
+	return upload, offset, true
+}
+
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version", nil)
+		return false
+	}
+	return true
+}
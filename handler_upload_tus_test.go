@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// createTusUpload starts a resumable upload of length bytes and returns its ID.
+func createTusUpload(t *testing.T, cfg *apiConfig, token string, videoID uuid.UUID, length int) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+videoID.String()+"/tus", nil)
+	req.SetPathValue("videoID", videoID.String())
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	rec := httptest.NewRecorder()
+	cfg.handlerTusCreate(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Create responded %d: %s", rec.Code, rec.Body)
+	}
+	return path.Base(rec.Header().Get("Location"))
+}
+
+func patchTusUpload(t *testing.T, cfg *apiConfig, token string, videoID uuid.UUID, uploadID string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPatch, "/api/video_upload/"+videoID.String()+"/tus/"+uploadID, bytes.NewReader(body))
+	req.SetPathValue("videoID", videoID.String())
+	req.SetPathValue("uploadID", uploadID)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	rec := httptest.NewRecorder()
+	cfg.handlerTusPatch(rec, req)
+	return rec
+}
+
+func TestTusUnsupportedUploadKeepsPublishedVideo(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	token, video := newReadyVideo(t, cfg)
+
+	body := []byte("an avi")
+	uploadID := createTusUpload(t, cfg, token, video.ID, len(body))
+	fake.Result.FormatName = "avi"
+	if rec := patchTusUpload(t, cfg, token, video.ID, uploadID, body); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Patch responded %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+	}
+
+	if status := getVideo(t, cfg, video.ID).Status; status != database.VideoStatusReady {
+		t.Errorf("Status = %q, want the published video %q", status, database.VideoStatusReady)
+	}
+}
+
+func TestExpiredTusUploadResetsVideo(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	token, video := newTestVideo(t, cfg)
+
+	uploadID := createTusUpload(t, cfg, token, video.ID, 100)
+	if status := getVideo(t, cfg, video.ID).Status; status != database.VideoStatusUploading {
+		t.Fatalf("Status = %q, want %q", status, database.VideoStatusUploading)
+	}
+
+	// Backdate the upload past its expiry
+	upload, err := cfg.tusUploads.readInfo(uploadID)
+	if err != nil {
+		t.Fatalf("Couldn't read upload: %v", err)
+	}
+	upload.CreatedAt = time.Now().Add(-tusUploadTTL - time.Minute)
+	data, _ := json.Marshal(upload)
+	if err := os.WriteFile(cfg.tusUploads.infoPath(uploadID), data, 0644); err != nil {
+		t.Fatalf("Couldn't write upload info: %v", err)
+	}
+
+	cfg.removeExpiredTusUploads()
+
+	if status := getVideo(t, cfg, video.ID).Status; status != database.VideoStatusDraft {
+		t.Errorf("Status = %q, want %q", status, database.VideoStatusDraft)
+	}
+	if _, err := os.Stat(cfg.tusUploads.dataPath(uploadID)); !os.IsNotExist(err) {
+		t.Errorf("Upload data left behind: %v", err)
+	}
+}
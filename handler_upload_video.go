@@ -1,22 +1,20 @@
 package main
 
 import (
-	"fmt"
+	"errors"
 	"io"
 	"mime"
 	"net/http"
 	"os"
-	"path"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
 	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-	const uploadLimit = 1 << 30 // 1 GB
-	r.Body = http.MaxBytesReader(w, r.Body, uploadLimit)
+	r.Body = http.MaxBytesReader(w, r.Body, videoUploadLimit)
 
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -47,6 +45,12 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Before reading what may be a large body
+	if err := cfg.checkQueueCapacity(); err != nil {
+		respondQueueFull(w, err)
+		return
+	}
+
 	file, header, err := r.FormFile("video")
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
@@ -59,91 +63,61 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type header", err)
 		return
 	}
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Invalid file type, only MP4 is allowed", nil)
+	if !isUploadVideoType(mediaType) {
+		respondWithError(w, http.StatusBadRequest, "Invalid file type, only MP4, MOV, WebM and MKV are allowed", nil)
 		return
 	}
 
-	actualMediaType, err := detectFileMediaType(file)
+	// ffprobe needs a file it can seek in, and it knows far more containers than DetectContentType
+	tempFile, err := os.CreateTemp("", tempFilePrefix)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to detect file type", err)
-		return
-	}
-	if !isMimeTypeMatch(mediaType, actualMediaType) {
-		respondWithError(w, http.StatusBadRequest, "Content-Type header doesn't match file type", nil)
-		return
-	}
-
-	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn not create temp file", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
 		return
 	}
 	defer os.Remove(tempFile.Name())
 	defer tempFile.Close()
 
 	if _, err := io.Copy(tempFile, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not write file to disk", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write temp file", err)
 		return
 	}
-
-	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not reset file pointer", err)
+	if _, err := cfg.validateUploadedVideo(media.WithOwner(r.Context(), userID.String()), tempFile.Name()); err != nil {
+		if errors.Is(err, errUnsupportedVideoType) {
+			respondWithError(w, http.StatusBadRequest, "File isn't a supported video", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't inspect video", err)
 		return
 	}
-
-	processedFilePath, err := processVideoForFastStart(tempFile.Name())
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError,
-			"Could not process video for fast start", fmt.Errorf("error processing video: %w", err))
-		return
-	}
-	defer os.Remove(processedFilePath)
-
-	processedFile, err := os.Open(processedFilePath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't read processed file", fmt.Errorf("error reading processed file: %w", err))
-	}
-	defer processedFile.Close()
-
-	// Reset the file pointer to be safe
-	if _, err := processedFile.Seek(0, io.SeekStart); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not reset processed file pointer", err)
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reset file pointer", err)
 		return
 	}
 
-	aspectRatio, err := getVideoAspectRatio(processedFilePath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error determining aspect ratio", err)
+	if err := cfg.beginVideoUpload(videoID); err != nil {
+		if errors.Is(err, database.ErrInvalidStatusTransition) {
+			respondWithError(w, http.StatusConflict, "Video is still being processed", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Could not update video status", err)
 		return
 	}
-	objPrefix := getObjectKeyPrefix(aspectRatio)
 
-	objBaseKey, err := getAssetPath(mediaType)
+	sourceKey, err := cfg.stageVideoUpload(r.Context(), videoID, tempFile, mediaType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not create object key", err)
+		cfg.abandonVideoUpload(video)
+		respondWithError(w, http.StatusInternalServerError, "Error uploading file to storage", err)
 		return
 	}
-	objKey := path.Join(objPrefix, objBaseKey)
 
-	_, err = cfg.s3Client.PutObject(r.Context(), &s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(objKey),
-		Body:        processedFile,
-		ContentType: aws.String(mediaType),
-	})
+	// Processing can take a while, so it happens in the background
+	queued, err := cfg.enqueueVideoProcessing(videoID, sourceKey)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error uploading file to S3", err)
-		return
-	}
-
-	videoURL := cfg.getObjectURL(objKey)
-	video.VideoURL = &videoURL
-
-	if err := cfg.db.UpdateVideo(video); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not update video", err)
+		cfg.deleteStagedUpload(r.Context(), sourceKey)
+		cfg.abandonVideoUpload(video)
+		respondWithError(w, http.StatusInternalServerError, "Could not queue video for processing", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	respondWithJSON(w, http.StatusAccepted, queued)
 }
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const testJWTSecret = "test-secret"
+
+// newTestConfig returns a config backed by a fresh SQLite database, in-memory
+// stores and a FakeProcessor, with the optional outputs turned off.
+func newTestConfig(t *testing.T) (*apiConfig, *media.FakeProcessor) {
+	t.Helper()
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	fake := media.NewFakeProcessor()
+	tusUploads, err := newTusStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Couldn't create tus store: %v", err)
+	}
+	cfg := &apiConfig{
+		db:              db,
+		jwtSecret:       testJWTSecret,
+		platform:        "dev",
+		assetStore:      storage.NewMemoryStore("http://localhost:8091/assets"),
+		videoStore:      storage.NewMemoryStore("http://localhost:8091/objects"),
+		storageBackend:  "memory",
+		progress:        newProgressHub(),
+		runningJobs:     newRunningJobs(),
+		tusUploads:      tusUploads,
+		media:           fake,
+		maxQueuedJobs:   100,
+		thumbnailOffset: 3 * time.Second,
+		audioRendition:  "none",
+	}
+	return cfg, fake
+}
+
+// newTestVideo creates a user owning a new draft video and returns an access token
+// for them along with the video.
+func newTestVideo(t *testing.T, cfg *apiConfig) (string, database.Video) {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: uuid.NewString() + "@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("Couldn't create user: %v", err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Test", Description: "A test video", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("Couldn't create video: %v", err)
+	}
+	token, err := auth.MakeJWT(user.ID, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatalf("Couldn't make JWT: %v", err)
+	}
+	return token, video
+}
+
+// uploadVideo posts body to the upload handler as a file of mediaType.
+func uploadVideo(t *testing.T, cfg *apiConfig, token string, videoID uuid.UUID, mediaType string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="upload.mp4"`)
+	header.Set("Content-Type", mediaType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatalf("Couldn't create form part: %v", err)
+	}
+	part.Write(body)
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+videoID.String(), &form)
+	req.SetPathValue("videoID", videoID.String())
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rec, req)
+	return rec
+}
+
+// runNextJob runs the next due job the way a worker would, failing the test if
+// there is none.
+func runNextJob(t *testing.T, cfg *apiConfig) database.Job {
+	t.Helper()
+	job, err := cfg.db.ClaimJob()
+	if err != nil {
+		t.Fatalf("Couldn't claim job: %v", err)
+	}
+	if job == nil {
+		t.Fatal("No job was queued")
+	}
+	cfg.runJob(context.Background(), cfg.jobHandlers(), *job)
+	return *job
+}
+
+func getVideo(t *testing.T, cfg *apiConfig, id uuid.UUID) database.Video {
+	t.Helper()
+	video, err := cfg.db.GetVideo(id)
+	if err != nil {
+		t.Fatalf("Couldn't get video: %v", err)
+	}
+	return video
+}
+
+func TestUploadVideoProcessesToReady(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	token, video := newTestVideo(t, cfg)
+
+	rec := uploadVideo(t, cfg, token, video.ID, "video/mp4", []byte("not really an mp4"))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Upload responded %d: %s", rec.Code, rec.Body)
+	}
+	var accepted database.Video
+	if err := json.NewDecoder(rec.Body).Decode(&accepted); err != nil {
+		t.Fatalf("Couldn't decode response: %v", err)
+	}
+	if accepted.Status != database.VideoStatusProcessing {
+		t.Errorf("Status after upload = %q, want %q", accepted.Status, database.VideoStatusProcessing)
+	}
+
+	runNextJob(t, cfg)
+
+	processed := getVideo(t, cfg, video.ID)
+	if processed.Status != database.VideoStatusReady {
+		t.Fatalf("Status after processing = %q (%v), want %q", processed.Status, processed.StatusError, database.VideoStatusReady)
+	}
+	if processed.VideoURL == nil {
+		t.Fatal("Processed video has no URL")
+	}
+	key, ok := storage.KeyFromURL(cfg.videoStore, *processed.VideoURL)
+	if !ok {
+		t.Fatalf("Video URL %q isn't in the video store", *processed.VideoURL)
+	}
+	if _, err := cfg.videoStore.Head(context.Background(), key); err != nil {
+		t.Errorf("Published video is missing: %v", err)
+	}
+	if processed.ThumbnailURL == nil {
+		t.Error("No thumbnail was generated")
+	}
+	if processed.Media == nil || processed.Media.DurationSeconds != fake.Result.DurationSeconds {
+		t.Errorf("Media info = %+v, want the probed duration", processed.Media)
+	}
+
+	// The raw upload is kept as the original, then removed
+	if processed.OriginalKey == nil {
+		t.Fatal("No original was kept")
+	}
+	original, err := cfg.videoStore.Get(context.Background(), *processed.OriginalKey)
+	if err != nil {
+		t.Fatalf("Couldn't get original: %v", err)
+	}
+	defer original.Close()
+	if data, _ := io.ReadAll(original); string(data) != "not really an mp4" {
+		t.Errorf("Original = %q, want the upload", data)
+	}
+	incoming, err := cfg.videoStore.List(context.Background(), incomingKeyPrefix(video.ID)+"/")
+	if err != nil {
+		t.Fatalf("Couldn't list incoming uploads: %v", err)
+	}
+	if len(incoming) != 0 {
+		t.Errorf("Incoming uploads left behind: %v", incoming)
+	}
+
+	calls := strings.Join(fake.Calls(), ",")
+	// Once on upload, once in the worker and once after fast start
+	if probes := strings.Count(calls, "Probe"); probes != 3 {
+		t.Errorf("Probed %d times, want 3, calls were %s", probes, calls)
+	}
+	for _, op := range []string{"Probe", "FastStart", "ExtractFrame"} {
+		if !strings.Contains(calls, op) {
+			t.Errorf("%s wasn't run, calls were %s", op, calls)
+		}
+	}
+}
+
+func TestUploadVideoRejectsInvalidMedia(t *testing.T) {
+	tests := []struct {
+		name      string
+		mediaType string
+		body      []byte
+		setup     func(fake *media.FakeProcessor)
+	}{
+		{
+			name:      "not a video type",
+			mediaType: "image/png",
+			body:      []byte("an image"),
+		},
+		{
+			name:      "empty file",
+			mediaType: "video/mp4",
+			body:      nil,
+		},
+		{
+			name:      "probe can't read it",
+			mediaType: "video/mp4",
+			body:      []byte("garbage"),
+			setup: func(fake *media.FakeProcessor) {
+				fake.Errors["Probe"] = fmt.Errorf("%w: moov atom not found", media.ErrInvalidMedia)
+			},
+		},
+		{
+			name:      "unsupported container",
+			mediaType: "video/mp4",
+			body:      []byte("an avi"),
+			setup: func(fake *media.FakeProcessor) {
+				fake.Result.FormatName = "avi"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, fake := newTestConfig(t)
+			if tt.setup != nil {
+				tt.setup(fake)
+			}
+			token, video := newTestVideo(t, cfg)
+
+			rec := uploadVideo(t, cfg, token, video.ID, tt.mediaType, tt.body)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("Upload responded %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+			}
+
+			unchanged := getVideo(t, cfg, video.ID)
+			if unchanged.Status != database.VideoStatusDraft {
+				t.Errorf("Status = %q, want it left %q", unchanged.Status, database.VideoStatusDraft)
+			}
+			if queued, err := cfg.db.CountQueuedJobs(); err != nil || queued != 0 {
+				t.Errorf("Queued jobs = %d (%v), want none", queued, err)
+			}
+		})
+	}
+}
+
+func TestUploadVideoRetriesFailedTranscode(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	// Only H.264 is published as it is, so this upload has to be transcoded
+	fake.Result.VideoCodec = "hevc"
+	fake.Errors["Transcode"] = fmt.Errorf("ffmpeg exited with status 1")
+	token, video := newTestVideo(t, cfg)
+
+	rec := uploadVideo(t, cfg, token, video.ID, "video/mp4", []byte("an hevc mp4"))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Upload responded %d: %s", rec.Code, rec.Body)
+	}
+
+	job := runNextJob(t, cfg)
+
+	retried, err := cfg.db.GetJob(job.ID)
+	if err != nil {
+		t.Fatalf("Couldn't get job: %v", err)
+	}
+	if retried.Status != database.JobStatusQueued {
+		t.Fatalf("Job status after a failed transcode = %q, want %q", retried.Status, database.JobStatusQueued)
+	}
+	if retried.LastError == nil || !strings.Contains(*retried.LastError, "ffmpeg exited") {
+		t.Errorf("Job error = %v, want the transcode error", retried.LastError)
+	}
+	if !retried.RunAt.After(time.Now()) {
+		t.Errorf("Retry is due at %v, want it backed off", retried.RunAt)
+	}
+	if status := getVideo(t, cfg, video.ID).Status; status != database.VideoStatusProcessing {
+		t.Errorf("Video status while waiting for the retry = %q, want %q", status, database.VideoStatusProcessing)
+	}
+
+	// The worker picks the job up again once the backoff is over
+	delete(fake.Errors, "Transcode")
+	cfg.runJob(context.Background(), cfg.jobHandlers(), retried)
+
+	done, err := cfg.db.GetJob(job.ID)
+	if err != nil {
+		t.Fatalf("Couldn't get job: %v", err)
+	}
+	if done.Status != database.JobStatusSucceeded {
+		t.Errorf("Job status after the retry = %q, want %q", done.Status, database.JobStatusSucceeded)
+	}
+	if processed := getVideo(t, cfg, video.ID); processed.Status != database.VideoStatusReady || processed.VideoURL == nil {
+		t.Errorf("Video after the retry has status %q and URL %v, want it ready", processed.Status, processed.VideoURL)
+	}
+}
+
+func TestUploadVideoGivesUpOnPermanentErrors(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	token, video := newTestVideo(t, cfg)
+
+	rec := uploadVideo(t, cfg, token, video.ID, "video/mp4", []byte("fine at upload"))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Upload responded %d: %s", rec.Code, rec.Body)
+	}
+
+	// Unreadable by the time the worker looks at it, which retrying won't fix
+	fake.Errors["Probe"] = fmt.Errorf("%w: truncated", media.ErrInvalidMedia)
+	job := runNextJob(t, cfg)
+
+	failed, err := cfg.db.GetJob(job.ID)
+	if err != nil {
+		t.Fatalf("Couldn't get job: %v", err)
+	}
+	if failed.Status != database.JobStatusFailed {
+		t.Errorf("Job status = %q, want %q", failed.Status, database.JobStatusFailed)
+	}
+	if status := getVideo(t, cfg, video.ID).Status; status != database.VideoStatusFailed {
+		t.Errorf("Video status = %q, want %q", status, database.VideoStatusFailed)
+	}
+}
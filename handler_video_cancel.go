@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerVideoCancelProcessing stops processing of a video's latest upload. A job
+// running on another server instance stops at its next heartbeat, so the video
+// may still be processing when this returns.
+func (cfg *apiConfig) handlerVideoCancelProcessing(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return
+	}
+	if video.Status != database.VideoStatusProcessing {
+		respondWithError(w, http.StatusConflict, "Video isn't being processed", nil)
+		return
+	}
+
+	queued, running, err := cfg.db.CancelVideoJobs(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't cancel processing", err)
+		return
+	}
+	if queued == 0 && running == 0 {
+		respondWithError(w, http.StatusConflict, "Video isn't being processed", nil)
+		return
+	}
+
+	if running > 0 {
+		// The job settles the video's status itself once it has stopped
+		cfg.runningJobs.cancel(videoID)
+	} else {
+		cfg.settleVideo(videoID, errJobCancelled)
+	}
+
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, video)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// handlerUploadCaptions adds a SubRip or WebVTT caption track to a video, replacing
+// the video's track for the same language.
+func (cfg *apiConfig) handlerUploadCaptions(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, captionsUploadLimit+(1<<20))
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	if err := r.ParseMultipartForm(captionsUploadLimit); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing multipart form", err)
+		return
+	}
+
+	language, ok := normalizeLanguageTag(r.FormValue("language"))
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid language, expected a tag like en or pt-BR", nil)
+		return
+	}
+	label := r.FormValue("label")
+	if label == "" {
+		label = language
+	}
+
+	file, _, err := r.FormFile("captions")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+	defer file.Close()
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, captionsUploadLimit+1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to read file", err)
+		return
+	}
+	if len(data) > captionsUploadLimit {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Captions file is too large", nil)
+		return
+	}
+
+	vtt, err := toWebVTT(data)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "File isn't SRT or WebVTT captions", err)
+		return
+	}
+
+	assetPath, err := getAssetPath(captionMediaType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create object key", err)
+		return
+	}
+	key := path.Join(captionsKeyPrefix(videoID), assetPath)
+	if err := cfg.videoStore.Put(r.Context(), key, bytes.NewReader(vtt), captionMediaType); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save captions", err)
+		return
+	}
+
+	previous, err := cfg.db.GetVideoCaption(videoID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	track := database.CaptionTrack{
+		Language: language,
+		Label:    label,
+		URL:      cfg.videoStore.URL(key),
+	}
+	if err := cfg.db.SetVideoCaption(videoID, track); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update captions", err)
+		return
+	}
+	if previous != nil {
+		cfg.deleteCaptionTrack(context.WithoutCancel(r.Context()), *previous)
+	}
+
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+func (cfg *apiConfig) handlerDeleteCaptions(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return
+	}
+
+	language, _ := normalizeLanguageTag(r.PathValue("language"))
+	track, err := cfg.db.GetVideoCaption(videoID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	if track == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no captions in that language", nil)
+		return
+	}
+
+	if err := cfg.db.DeleteVideoCaption(videoID, language); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete captions", err)
+		return
+	}
+	cfg.deleteCaptionTrack(context.WithoutCancel(r.Context()), *track)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteCaptionTrack removes the file of a track that is no longer used. Failures are
+// retried in the background like other deletions.
+func (cfg *apiConfig) deleteCaptionTrack(ctx context.Context, track database.CaptionTrack) {
+	key, ok := storage.KeyFromURL(cfg.videoStore, track.URL)
+	if !ok {
+		return
+	}
+	deletions, err := cfg.db.QueueObjectDeletions([]database.ObjectRef{{Store: videoStoreName, Key: key}})
+	if err != nil {
+		log.Printf("Couldn't queue deletion of captions %s: %v", key, err)
+		return
+	}
+	cfg.runObjectDeletions(ctx, deletions)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+const (
+	// Status changes made by other server instances only show up in the database
+	videoEventsPollInterval = 2 * time.Second
+	// Keeps proxies from closing the stream while nothing happens
+	videoEventsKeepAlive = 15 * time.Second
+	// Long enough to open the stream and ride out a reconnect or two
+	videoEventsTokenTTL = 5 * time.Minute
+)
+
+// handlerVideoEventsToken hands out a short-lived token for following one video's
+// events. EventSource can't send headers, so the token goes in the stream's query
+// string, where the access token would end up in logs and browser history.
+func (cfg *apiConfig) handlerVideoEventsToken(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to view this video", nil)
+		return
+	}
+
+	eventsToken, err := auth.MakeVideoEventsToken(userID, videoID, cfg.jwtSecret, videoEventsTokenTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create token", err)
+		return
+	}
+
+	type response struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		Token:     eventsToken,
+		ExpiresAt: time.Now().UTC().Add(videoEventsTokenTTL),
+	})
+}
+
+// handlerVideoEvents streams a video's status and processing progress as
+// Server-Sent Events: a "status" event with the whole video whenever its status
+// changes, starting with the current one, and "progress" events while it's processed.
+func (cfg *apiConfig) handlerVideoEvents(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	// Browsers pass an events token in the query string, other clients can use
+	// the access token as usual
+	var userID uuid.UUID
+	if eventsToken := r.URL.Query().Get("token"); eventsToken != "" {
+		userID, err = auth.ValidateVideoEventsToken(eventsToken, cfg.jwtSecret, videoID)
+	} else {
+		token, tokenErr := auth.GetBearerToken(r.Header)
+		if tokenErr != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", tokenErr)
+			return
+		}
+		userID, err = auth.ValidateJWT(token, cfg.jwtSecret)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to view this video", nil)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming isn't supported", nil)
+		return
+	}
+
+	// Subscribe before sending the status so no progress falls in between
+	events, unsubscribe := cfg.progress.subscribe(videoID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeEvent(w, "status", video); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	poll := time.NewTicker(videoEventsPollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(videoEventsKeepAlive)
+	defer keepAlive.Stop()
+
+	lastStatus := video.Status
+	checkStatus := func() error {
+		video, err := cfg.db.GetVideo(videoID)
+		if err != nil {
+			log.Printf("Couldn't check status of video %s: %v", videoID, err)
+			return nil
+		}
+		if video.ID == uuid.Nil {
+			return fmt.Errorf("video %s was deleted", videoID)
+		}
+		if video.Status == lastStatus {
+			return nil
+		}
+		lastStatus = video.Status
+		return writeEvent(w, "status", video)
+	}
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if event.Done {
+				err = checkStatus()
+			} else {
+				err = writeEvent(w, "progress", event)
+			}
+		case <-poll.C:
+			err = checkStatus()
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 
@@ -72,12 +73,18 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	deletions, err := cfg.db.DeleteVideoAndQueueObjects(videoID, cfg.videoObjectRefs(video))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
 
+	// A job still running here would keep storing outputs for a video that's gone
+	cfg.runningJobs.cancel(videoID)
+
+	// The video is gone either way; anything that fails here is retried in the background
+	cfg.runObjectDeletions(context.WithoutCancel(r.Context()), deletions)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
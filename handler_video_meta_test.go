@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDeleteVideoCancelsItsJobs(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	token, video := newTestVideo(t, cfg)
+
+	if rec := uploadVideo(t, cfg, token, video.ID, "video/mp4", []byte("an mp4")); rec.Code != http.StatusAccepted {
+		t.Fatalf("Upload responded %d: %s", rec.Code, rec.Body)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/videos/"+video.ID.String(), nil)
+	req.SetPathValue("videoID", video.ID.String())
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.handlerVideoMetaDelete(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Delete responded %d: %s", rec.Code, rec.Body)
+	}
+
+	active, err := cfg.db.GetActiveJobs()
+	if err != nil {
+		t.Fatalf("Couldn't get jobs: %v", err)
+	}
+	if len(active) != 0 {
+		t.Errorf("Jobs still queued or running for the deleted video: %+v", active)
+	}
+	if deleted := getVideo(t, cfg, video.ID); deleted.ID != uuid.Nil {
+		t.Errorf("Video still exists with status %q", deleted.Status)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerVideoReprocess queues processing a video's original again, e.g. to apply
+// a changed watermark. The result replaces the published video once it's ready.
+func (cfg *apiConfig) handlerVideoReprocess(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return
+	}
+
+	// Videos processed before originals were kept have nothing to start over from
+	if video.OriginalKey == nil {
+		respondWithError(w, http.StatusConflict, "Video has no original to reprocess, upload it again instead", nil)
+		return
+	}
+
+	if err := cfg.checkQueueCapacity(); err != nil {
+		respondQueueFull(w, err)
+		return
+	}
+
+	video, err = cfg.enqueueVideoProcessing(videoID, *video.OriginalKey)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidStatusTransition) {
+			respondWithError(w, http.StatusConflict, "Video is already being processed", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Could not queue video for processing", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, video)
+}
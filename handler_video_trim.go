@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// handlerVideoTrim queues cutting a processed video down to the part between start
+// and end. The trimmed video is published as a new object, replacing the current one.
+func (cfg *apiConfig) handlerVideoTrim(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Start clipTimestamp `json:"start"`
+		// Omitted or 0 trims only the beginning
+		End clipTimestamp `json:"end"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	start, end := time.Duration(params.Start), time.Duration(params.End)
+	if end != 0 && end <= start {
+		respondWithError(w, http.StatusBadRequest, "end must be after start", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return
+	}
+
+	if video.Status != database.VideoStatusReady || video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Only processed videos can be trimmed", nil)
+		return
+	}
+	sourceKey, ok := storage.KeyFromURL(cfg.videoStore, *video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusConflict, "Video isn't stored where it can be trimmed", nil)
+		return
+	}
+
+	if video.Media != nil {
+		duration := time.Duration(video.Media.DurationSeconds * float64(time.Second))
+		if start >= duration {
+			respondWithError(w, http.StatusBadRequest, "start is past the end of the video", nil)
+			return
+		}
+		if end >= duration {
+			end = 0
+		}
+	}
+	if start == 0 && end == 0 {
+		respondWithError(w, http.StatusBadRequest, "Trimming would keep the whole video", nil)
+		return
+	}
+
+	if err := cfg.checkQueueCapacity(); err != nil {
+		respondQueueFull(w, err)
+		return
+	}
+
+	video, err = cfg.enqueueVideoJob(videoID, jobKindTrimVideo, trimVideoPayload{
+		SourceKey: sourceKey,
+		Start:     start,
+		End:       end,
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidStatusTransition) {
+			respondWithError(w, http.StatusConflict, "Video is already being processed", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Could not queue video for trimming", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, video)
+}
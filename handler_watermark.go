@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+func (cfg *apiConfig) handlerWatermarkGet(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	watermark, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+	if watermark == nil {
+		respondWithError(w, http.StatusNotFound, "No watermark set", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, watermark)
+}
+
+// handlerWatermarkSet sets the watermark for the user's videos processed from now
+// on. The image may be left out to only change the other settings.
+func (cfg *apiConfig) handlerWatermarkSet(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, watermarkUploadLimit+(1<<20))
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	if err := r.ParseMultipartForm(watermarkUploadLimit); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing multipart form", err)
+		return
+	}
+
+	previous, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+	watermark := database.Watermark{
+		UserID:   userID,
+		Position: defaultWatermarkPosition,
+		Opacity:  defaultWatermarkOpacity,
+		Scale:    defaultWatermarkScale,
+	}
+	if previous != nil {
+		watermark = *previous
+	}
+
+	if position := r.FormValue("position"); position != "" {
+		watermark.Position = position
+	}
+	for name, value := range map[string]*float64{"opacity": &watermark.Opacity, "scale": &watermark.Scale} {
+		raw := r.FormValue(name)
+		if raw == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, name+" must be a number", err)
+			return
+		}
+		*value = parsed
+	}
+	if err := validateWatermark(watermark.Position, watermark.Opacity, watermark.Scale); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	file, header, err := r.FormFile("image")
+	switch {
+	case errors.Is(err, http.ErrMissingFile) && previous != nil:
+	case errors.Is(err, http.ErrMissingFile):
+		respondWithError(w, http.StatusBadRequest, "A new watermark needs an image", err)
+		return
+	case err != nil:
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	default:
+		defer file.Close()
+
+		mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid Content-Type header", err)
+			return
+		}
+		// PNG for logos with a transparent background
+		if mediaType != "image/png" && mediaType != "image/jpeg" {
+			respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
+			return
+		}
+
+		data, err := io.ReadAll(io.LimitReader(file, watermarkUploadLimit+1))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Unable to read file", err)
+			return
+		}
+		if len(data) > watermarkUploadLimit {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Watermark image is too large", nil)
+			return
+		}
+		_, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || "image/"+format != mediaType {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode image", err)
+			return
+		}
+
+		assetPath, err := getAssetPath(mediaType)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create object key", err)
+			return
+		}
+		key := path.Join(watermarksKeyPrefix(userID), assetPath)
+		if err := cfg.videoStore.Put(r.Context(), key, bytes.NewReader(data), mediaType); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save watermark", err)
+			return
+		}
+		watermark.ImageURL = cfg.videoStore.URL(key)
+	}
+
+	if err := cfg.db.SetWatermark(watermark); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update watermark", err)
+		return
+	}
+	if previous != nil && previous.ImageURL != watermark.ImageURL {
+		cfg.deleteWatermarkImage(context.WithoutCancel(r.Context()), *previous)
+	}
+
+	updated, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, updated)
+}
+
+// handlerWatermarkDelete removes the user's watermark, so their videos get the
+// global one, if any, from now on.
+func (cfg *apiConfig) handlerWatermarkDelete(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	watermark, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+	if watermark == nil {
+		respondWithError(w, http.StatusNotFound, "No watermark set", nil)
+		return
+	}
+
+	if err := cfg.db.DeleteWatermark(userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete watermark", err)
+		return
+	}
+	cfg.deleteWatermarkImage(context.WithoutCancel(r.Context()), *watermark)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteWatermarkImage removes an image no watermark uses any more. Failures are
+// retried in the background like other deletions.
+func (cfg *apiConfig) deleteWatermarkImage(ctx context.Context, watermark database.Watermark) {
+	key, ok := storage.KeyFromURL(cfg.videoStore, watermark.ImageURL)
+	if !ok {
+		return
+	}
+	deletions, err := cfg.db.QueueObjectDeletions([]database.ObjectRef{{Store: videoStoreName, Key: key}})
+	if err != nil {
+		log.Printf("Couldn't queue deletion of watermark %s: %v", key, err)
+		return
+	}
+	cfg.runObjectDeletions(ctx, deletions)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// thumbnailWidths are the sizes thumbnails are scaled down to for srcset. The
+// original size is always included as well.
+var thumbnailWidths = []int{320, 640, 1280}
+
+// A small file can claim a huge canvas, so check the size before decoding
+const maxThumbnailPixels = 50_000_000
+
+const webpMediaType = "image/webp"
+
+var errInvalidImage = errors.New("invalid image")
+
+// storedThumbnail is a thumbnail saved to the asset store with its variants.
+type storedThumbnail struct {
+	Key    string
+	URL    string
+	Srcset database.ThumbnailSrcset
+}
+
+// storeThumbnail decodes a JPEG or PNG and stores it re-encoded, which leaves its
+// EXIF and other metadata behind, along with scaled down and WebP variants under
+// derivedKeyPrefix of its key. The error wraps errInvalidImage when data can't be used.
+func (cfg *apiConfig) storeThumbnail(ctx context.Context, data []byte, mediaType string) (storedThumbnail, error) {
+	img, err := decodeThumbnail(data, mediaType)
+	if err != nil {
+		return storedThumbnail{}, err
+	}
+
+	key, err := getAssetPath(mediaType)
+	if err != nil {
+		return storedThumbnail{}, fmt.Errorf("error getting asset path: %w", err)
+	}
+	ext := path.Ext(key)
+
+	workDir, err := os.MkdirTemp("", tempFilePrefix+"-image-*")
+	if err != nil {
+		return storedThumbnail{}, fmt.Errorf("error creating work directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	width := img.Bounds().Dx()
+	widths := []int{}
+	for _, w := range thumbnailWidths {
+		if w < width {
+			widths = append(widths, w)
+		}
+	}
+	widths = append(widths, width)
+
+	stored := storedThumbnail{
+		Key:    key,
+		URL:    cfg.assetStore.URL(key),
+		Srcset: database.ThumbnailSrcset{},
+	}
+	webp := true
+	for _, w := range widths {
+		name := strconv.Itoa(w)
+		variant, variantKey := img, key
+		if w != width {
+			variant = resizeImage(img, w)
+			variantKey = path.Join(derivedKeyPrefix(key), name+ext)
+		}
+
+		localPath := filepath.Join(workDir, name+ext)
+		if err := encodeImageFile(localPath, variant, mediaType); err != nil {
+			return storedThumbnail{}, err
+		}
+		if err := cfg.putAssetFile(ctx, variantKey, localPath, mediaType); err != nil {
+			return storedThumbnail{}, err
+		}
+		stored.Srcset.Add(mediaType, w, cfg.assetStore.URL(variantKey))
+
+		if !webp {
+			continue
+		}
+		webpPath := filepath.Join(workDir, name+".webp")
+		if err := cfg.media.ExtractFrame(ctx, localPath, webpPath, media.FrameOptions{Quality: 80}); err != nil {
+			// Not every ffmpeg build has libwebp, and the JPEG/PNG variants work everywhere
+			log.Printf("Couldn't create WebP thumbnails: %v", err)
+			webp = false
+			continue
+		}
+		webpKey := path.Join(derivedKeyPrefix(key), name+".webp")
+		if err := cfg.putAssetFile(ctx, webpKey, webpPath, webpMediaType); err != nil {
+			return storedThumbnail{}, err
+		}
+		stored.Srcset.Add(webpMediaType, w, cfg.assetStore.URL(webpKey))
+	}
+	return stored, nil
+}
+
+func (cfg *apiConfig) putAssetFile(ctx context.Context, key, filePath, mediaType string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	if err := cfg.assetStore.Put(ctx, key, file, mediaType); err != nil {
+		return fmt.Errorf("error saving %s: %w", key, err)
+	}
+	return nil
+}
+
+// decodeThumbnail decodes a JPEG or PNG, turning JPEGs upright according to their
+// EXIF orientation since the tag doesn't survive re-encoding.
+func decodeThumbnail(data []byte, mediaType string) (image.Image, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	if "image/"+format != mediaType {
+		return nil, fmt.Errorf("%w: %s isn't %s", errInvalidImage, format, mediaType)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxThumbnailPixels {
+		return nil, fmt.Errorf("%w: %dx%d is too large", errInvalidImage, config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	return img, nil
+}
+
+func encodeImageFile(filePath string, img image.Image, mediaType string) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	switch mediaType {
+	case "image/png":
+		err = png.Encode(file, img)
+	default:
+		err = jpeg.Encode(file, img, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %w", filePath, err)
+	}
+	return file.Close()
+}
+
+// resizeImage scales img down to width, keeping its aspect ratio. Each output pixel
+// averages the source pixels it covers, which keeps fine detail from aliasing.
+func resizeImage(img image.Image, width int) *image.RGBA64 {
+	b := img.Bounds()
+	height := max(1, int(math.Round(float64(b.Dy())*float64(width)/float64(b.Dx()))))
+	dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+
+	for dy := 0; dy < height; dy++ {
+		y0 := b.Min.Y + dy*b.Dy()/height
+		y1 := max(y0+1, b.Min.Y+(dy+1)*b.Dy()/height)
+		for dx := 0; dx < width; dx++ {
+			x0 := b.Min.X + dx*b.Dx()/width
+			x1 := max(x0+1, b.Min.X+(dx+1)*b.Dx()/width)
+
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					cr, cg, cb, ca := img.At(x, y).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(dx, dy, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// applyOrientation undoes an EXIF orientation (1-8), which describes how the
+// camera stored the picture relative to how it should be shown.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA64(image.Rect(0, 0, dw, dh))
+
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-dx, dy
+			case 3: // upside down
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // mirrored upside down
+				sx, sy = dx, h-1-dy
+			case 5: // mirrored, rotated 90° counter-clockwise
+				sx, sy = dy, dx
+			case 6: // rotated 90° counter-clockwise
+				sx, sy = dy, h-1-dx
+			case 7: // mirrored, rotated 90° clockwise
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // rotated 90° clockwise
+				sx, sy = w-1-dy, dx
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation from a JPEG, returning 1 (upright)
+// when there isn't one.
+func jpegOrientation(data []byte) int {
+	const (
+		markerSOS  = 0xDA // start of scan, the image data follows
+		markerAPP1 = 0xE1 // where EXIF lives
+	)
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		if marker == markerSOS {
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if size < 2 || pos+2+size > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+size]
+		if marker == markerAPP1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + size
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag in the first IFD of a TIFF-structured
+// EXIF block.
+func exifOrientation(tiff []byte) int {
+	const tagOrientation = 0x0112
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == tagOrientation {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 1
+}
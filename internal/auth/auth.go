@@ -18,6 +18,8 @@ type TokenType string
 
 const (
 	TokenTypeAccess TokenType = "tubely-access"
+	// Only lets its holder follow one video's events, so it can go in a URL
+	TokenTypeVideoEvents TokenType = "tubely-video-events"
 )
 
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
@@ -50,6 +52,50 @@ func MakeJWT(
 }
 
 func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+	claims, err := validateToken(tokenString, tokenSecret, TokenTypeAccess)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return userIDFromClaims(claims)
+}
+
+// MakeVideoEventsToken makes a token that only grants following the events of
+// the video with videoID.
+func MakeVideoEventsToken(
+	userID uuid.UUID,
+	videoID uuid.UUID,
+	tokenSecret string,
+	expiresIn time.Duration,
+) (string, error) {
+	signingKey := []byte(tokenSecret)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    string(TokenTypeVideoEvents),
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+		Subject:   userID.String(),
+		Audience:  jwt.ClaimStrings{videoID.String()},
+	})
+	return token.SignedString(signingKey)
+}
+
+// ValidateVideoEventsToken returns the user a video events token was made for,
+// failing unless it was made for the video with videoID.
+func ValidateVideoEventsToken(tokenString, tokenSecret string, videoID uuid.UUID) (uuid.UUID, error) {
+	claims, err := validateToken(tokenString, tokenSecret, TokenTypeVideoEvents)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	audience, err := claims.GetAudience()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if len(audience) != 1 || audience[0] != videoID.String() {
+		return uuid.Nil, errors.New("token is for another video")
+	}
+	return userIDFromClaims(claims)
+}
+
+func validateToken(tokenString, tokenSecret string, tokenType TokenType) (*jwt.RegisteredClaims, error) {
 	claimsStruct := jwt.RegisteredClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
@@ -57,21 +103,24 @@ func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return nil, err
 	}
 
-	userIDString, err := token.Claims.GetSubject()
+	issuer, err := token.Claims.GetIssuer()
 	if err != nil {
-		return uuid.Nil, err
+		return nil, err
 	}
+	if issuer != string(tokenType) {
+		return nil, errors.New("invalid issuer")
+	}
+	return &claimsStruct, nil
+}
 
-	issuer, err := token.Claims.GetIssuer()
+func userIDFromClaims(claims *jwt.RegisteredClaims) (uuid.UUID, error) {
+	userIDString, err := claims.GetSubject()
 	if err != nil {
 		return uuid.Nil, err
 	}
-	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
-	}
 
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CaptionTrack is a WebVTT captions or subtitles file for one language of a video.
+type CaptionTrack struct {
+	// BCP 47 language tag, e.g. "en" or "pt-BR"
+	Language string `json:"language"`
+	// Shown in the player's track menu, e.g. "English (CC)"
+	Label     string    `json:"label"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const captionColumns = `
+		video_id,
+		language,
+		label,
+		url,
+		created_at,
+		updated_at`
+
+func scanCaptionTrack(row rowScanner) (uuid.UUID, CaptionTrack, error) {
+	var videoID uuid.UUID
+	var track CaptionTrack
+	err := row.Scan(
+		&videoID,
+		&track.Language,
+		&track.Label,
+		&track.URL,
+		&track.CreatedAt,
+		&track.UpdatedAt,
+	)
+	return videoID, track, err
+}
+
+// GetVideoCaption returns a video's track for language, or nil if it has none.
+func (c Client) GetVideoCaption(videoID uuid.UUID, language string) (*CaptionTrack, error) {
+	query := `
+	SELECT` + captionColumns + `
+	FROM video_captions
+	WHERE video_id = ? AND language = ?
+	`
+	_, track, err := scanCaptionTrack(c.db.QueryRow(query, videoID, language))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &track, nil
+}
+
+// SetVideoCaption adds a video's track for track.Language or replaces the existing one.
+func (c Client) SetVideoCaption(videoID uuid.UUID, track CaptionTrack) error {
+	now := time.Now().UTC()
+	query := `
+	INSERT INTO video_captions (
+		video_id,
+		language,
+		label,
+		url,
+		created_at,
+		updated_at
+	) VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (video_id, language) DO UPDATE SET
+		label = excluded.label,
+		url = excluded.url,
+		updated_at = excluded.updated_at
+	`
+	_, err := c.db.Exec(query, videoID, track.Language, track.Label, track.URL, now, now)
+	return err
+}
+
+// ReplaceVideoCaptionURL points a video's track for language at newURL, unless the
+// track was replaced or removed since it pointed at oldURL. It reports whether it did.
+func (c Client) ReplaceVideoCaptionURL(videoID uuid.UUID, language, oldURL, newURL string) (bool, error) {
+	query := `
+	UPDATE video_captions
+	SET
+		url = ?,
+		updated_at = ?
+	WHERE video_id = ? AND language = ? AND url = ?
+	`
+	result, err := c.db.Exec(query, newURL, time.Now().UTC(), videoID, language, oldURL)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (c Client) DeleteVideoCaption(videoID uuid.UUID, language string) error {
+	query := `
+	DELETE FROM video_captions
+	WHERE video_id = ? AND language = ?
+	`
+	_, err := c.db.Exec(query, videoID, language)
+	return err
+}
+
+// Keeps the IN list of attachCaptions well below SQLite's limit on query parameters
+const captionsBatchSize = 500
+
+// attachCaptions loads the caption tracks of videos, a batch of videos per query.
+func (c Client) attachCaptions(videos []Video) error {
+	byID := map[uuid.UUID]*Video{}
+	for i := range videos {
+		videos[i].Captions = []CaptionTrack{}
+		byID[videos[i].ID] = &videos[i]
+	}
+
+	for start := 0; start < len(videos); start += captionsBatchSize {
+		args := []any{}
+		for _, video := range videos[start:min(start+captionsBatchSize, len(videos))] {
+			args = append(args, video.ID)
+		}
+		query := `
+		SELECT` + captionColumns + `
+		FROM video_captions
+		WHERE video_id IN (?` + strings.Repeat(", ?", len(args)-1) + `)
+		ORDER BY language
+		`
+		if err := c.queryCaptions(byID, query, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Client) queryCaptions(byID map[uuid.UUID]*Video, query string, args []any) error {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		videoID, track, err := scanCaptionTrack(rows)
+		if err != nil {
+			return err
+		}
+		if video, ok := byID[videoID]; ok {
+			video.Captions = append(video.Captions, track)
+		}
+	}
+	return rows.Err()
+}
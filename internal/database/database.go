@@ -1,30 +1,61 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type Client struct {
-	db *sql.DB
+	db dbConn
 }
 
-func NewClient(pathToDB string) (Client, error) {
-	db, err := sql.Open("sqlite3", pathToDB)
+// migrationLockID is the PostgreSQL advisory lock held while migrating, so server
+// instances starting together don't race to alter the same tables.
+const migrationLockID = 7305119432
+
+// NewClient connects to the database at dbURL, a postgres:// URL or the path of a
+// SQLite database, and brings its schema up to date.
+func NewClient(dbURL string) (Client, error) {
+	d, dsn, err := parseDBURL(dbURL)
+	if err != nil {
+		return Client{}, err
+	}
+	db, err := sql.Open(string(d), dsn)
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
-	err = c.autoMigrate()
+	c := Client{dbConn{DB: db, dialect: d}}
+	err = c.migrate()
 	if err != nil {
+		db.Close()
 		return Client{}, err
 	}
 	return c, nil
 
 }
 
+func (c *Client) migrate() error {
+	if c.db.dialect != dialectPostgres {
+		return c.autoMigrate()
+	}
+
+	ctx := context.Background()
+	lockConn, err := c.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer lockConn.Close()
+	if _, err := lockConn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	defer lockConn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+	return c.autoMigrate()
+}
+
 func (c *Client) autoMigrate() error {
 	userTable := `
 	CREATE TABLE IF NOT EXISTS users (
@@ -63,8 +94,8 @@ func (c *Client) autoMigrate() error {
 		title TEXT NOT NULL,
 		description TEXT,
 		thumbnail_url TEXT,
-		video_url TEXT TEXT,
-		user_id INTEGER,
+		video_url TEXT,
+		user_id TEXT,
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);
 	`
@@ -72,18 +103,239 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	objectDeletionTable := `
+	CREATE TABLE IF NOT EXISTS object_deletions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		store TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		is_prefix BOOLEAN NOT NULL DEFAULT FALSE,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		next_attempt_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(objectDeletionTable)
+	if err != nil {
+		return err
+	}
+
+	jobTable := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		kind TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL,
+		last_error TEXT,
+		run_at TIMESTAMP NOT NULL,
+		locked_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS jobs_status_run_at ON jobs (status, run_at);
+	`
+	_, err = c.db.Exec(jobTable)
+	if err != nil {
+		return err
+	}
+	if err := c.addColumn("jobs", "cancel_requested_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	if err := c.addColumn("jobs", "started_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+
+	mediaInfoTable := `
+	CREATE TABLE IF NOT EXISTS video_media_info (
+		video_id TEXT PRIMARY KEY,
+		duration_seconds DOUBLE PRECISION NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		video_codec TEXT NOT NULL,
+		audio_codec TEXT,
+		audio_channels INTEGER NOT NULL,
+		bit_rate INTEGER NOT NULL,
+		frame_rate DOUBLE PRECISION NOT NULL,
+		format_name TEXT NOT NULL,
+		probed_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(mediaInfoTable)
+	if err != nil {
+		return err
+	}
+	if err := c.addColumn("video_media_info", "integrated_loudness", "DOUBLE PRECISION"); err != nil {
+		return err
+	}
+
+	captionsTable := `
+	CREATE TABLE IF NOT EXISTS video_captions (
+		video_id TEXT NOT NULL,
+		language TEXT NOT NULL,
+		label TEXT NOT NULL,
+		url TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (video_id, language),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(captionsTable)
+	if err != nil {
+		return err
+	}
+
+	watermarksTable := `
+	CREATE TABLE IF NOT EXISTS watermarks (
+		user_id TEXT PRIMARY KEY,
+		image_url TEXT NOT NULL,
+		position TEXT NOT NULL,
+		opacity DOUBLE PRECISION NOT NULL,
+		scale DOUBLE PRECISION NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(watermarksTable)
+	if err != nil {
+		return err
+	}
+
+	if err := c.migrateVideoStatus(); err != nil {
+		return err
+	}
+
+	// Columns added to videos after the table was first created
+	videoColumns := []struct{ name, definition string }{
+		{"hls_url", "TEXT"},
+		{"dash_url", "TEXT"},
+		{"aspect_ratio", "TEXT"},
+		{"thumbnail_srcset", "TEXT"},
+		{"preview_url", "TEXT"},
+		{"thumbnail_track_url", "TEXT"},
+		{"audio_url", "TEXT"},
+		{"original_key", "TEXT"},
+	}
+	for _, col := range videoColumns {
+		if err := c.addColumn("videos", col.name, col.definition); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// migrateVideoStatus replaces the processing_status column of older databases
+// with the status lifecycle columns.
+func (c *Client) migrateVideoStatus() error {
+	hadStatus, err := c.hasColumn("videos", "status")
+	if err != nil {
+		return err
+	}
+
+	columns := []struct{ name, definition string }{
+		{"status", "TEXT NOT NULL DEFAULT 'draft'"},
+		{"status_error", "TEXT"},
+		{"status_updated_at", "TIMESTAMP"},
+		{"processing_started_at", "TIMESTAMP"},
+		{"ready_at", "TIMESTAMP"},
+	}
+	for _, col := range columns {
+		if err := c.addColumn("videos", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	if hadStatus {
+		return nil
+	}
+
+	hasProcessingStatus, err := c.hasColumn("videos", "processing_status")
+	if err != nil {
+		return err
+	}
+	if !hasProcessingStatus {
+		_, err := c.db.Exec("UPDATE videos SET status = 'ready' WHERE video_url IS NOT NULL")
+		return err
+	}
+
+	query := `
+	UPDATE videos
+	SET status = CASE
+		WHEN processing_status IN ('queued', 'processing') THEN 'processing'
+		WHEN processing_status = 'failed' THEN 'failed'
+		WHEN processing_status = 'done' OR video_url IS NOT NULL THEN 'ready'
+		ELSE 'draft'
+	END
+	`
+	if _, err := c.db.Exec(query); err != nil {
+		return err
+	}
+	_, err = c.db.Exec("ALTER TABLE videos DROP COLUMN processing_status")
+	return err
+}
+
+func (c *Client) hasColumn(table, column string) (bool, error) {
+	query := fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table)
+	if c.db.dialect == dialectPostgres {
+		query = fmt.Sprintf("SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = '%s'", table)
+	}
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// addColumn adds a column to an existing table, since CREATE TABLE IF NOT EXISTS
+// leaves tables created by older versions alone.
+func (c *Client) addColumn(table, column, definition string) error {
+	exists, err := c.hasColumn(table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// Reset empties every table, children before the tables their foreign keys point at.
 func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
-		return fmt.Errorf("failed to reset table users: %w", err)
+	if _, err := c.db.Exec("DELETE FROM watermarks"); err != nil {
+		return fmt.Errorf("failed to reset table watermarks: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM jobs"); err != nil {
+		return fmt.Errorf("failed to reset table jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_media_info"); err != nil {
+		return fmt.Errorf("failed to reset table video_media_info: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_captions"); err != nil {
+		return fmt.Errorf("failed to reset table video_captions: %w", err)
 	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
+		return fmt.Errorf("failed to reset table users: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// dialect is the SQL flavour of the database behind a Client, named after its driver.
+type dialect string
+
+const (
+	dialectSQLite   dialect = "sqlite3"
+	dialectPostgres dialect = "postgres"
+)
+
+// parseDBURL picks the dialect for dbURL and returns the data source name for its
+// driver. postgres:// and postgresql:// URLs are PostgreSQL. Anything else is a
+// SQLite database, given as a file path with an optional sqlite:// prefix.
+func parseDBURL(dbURL string) (dialect, string, error) {
+	scheme, rest, ok := strings.Cut(dbURL, "://")
+	if !ok {
+		return dialectSQLite, dbURL, nil
+	}
+	switch scheme {
+	case "postgres", "postgresql":
+		u, err := url.Parse(dbURL)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid database URL: %w", err)
+		}
+		// TIMESTAMP columns hold UTC, also where the database fills them in
+		query := u.Query()
+		if !query.Has("timezone") {
+			query.Set("timezone", "UTC")
+			u.RawQuery = query.Encode()
+		}
+		return dialectPostgres, u.String(), nil
+	case "sqlite", "sqlite3":
+		return dialectSQLite, rest, nil
+	}
+	return "", "", fmt.Errorf("unsupported database URL scheme %q, expected postgres or sqlite", scheme)
+}
+
+// rebind rewrites the ? placeholders queries are written with into the dialect's,
+// leaving question marks in string literals alone.
+func (d dialect) rebind(query string) string {
+	if d != dialectPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var out strings.Builder
+	n := 0
+	inString := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inString = !inString
+		case r == '?' && !inString:
+			n++
+			out.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// skipLocked is the locking clause of a SELECT picking rows to claim, so concurrent
+// claims skip rows another transaction is claiming instead of waiting for them.
+// SQLite has no row locks, it serializes writes instead.
+func (d dialect) skipLocked(table string) string {
+	if d != dialectPostgres {
+		return ""
+	}
+	return "FOR UPDATE OF " + table + " SKIP LOCKED"
+}
+
+// execer is implemented by both dbConn and dbTx, for statements that run either on
+// their own or as part of a transaction.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// dbConn is a *sql.DB taking queries with ? placeholders whatever the dialect.
+type dbConn struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (c dbConn) Exec(query string, args ...any) (sql.Result, error) {
+	return c.DB.Exec(c.dialect.rebind(query), args...)
+}
+
+func (c dbConn) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.DB.Query(c.dialect.rebind(query), args...)
+}
+
+func (c dbConn) QueryRow(query string, args ...any) *sql.Row {
+	return c.DB.QueryRow(c.dialect.rebind(query), args...)
+}
+
+func (c dbConn) Begin() (dbTx, error) {
+	sqlTx, err := c.DB.Begin()
+	return dbTx{Tx: sqlTx, dialect: c.dialect}, err
+}
+
+// dbTx is dbConn for a transaction.
+type dbTx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (t dbTx) Exec(query string, args ...any) (sql.Result, error) {
+	return t.Tx.Exec(t.dialect.rebind(query), args...)
+}
+
+func (t dbTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.Tx.Query(t.dialect.rebind(query), args...)
+}
+
+func (t dbTx) QueryRow(query string, args ...any) *sql.Row {
+	return t.Tx.QueryRow(t.dialect.rebind(query), args...)
+}
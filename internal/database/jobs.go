@@ -0,0 +1,392 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type JobStatus string
+
+const (
+	JobStatusQueued    JobStatus = "queued"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusSucceeded JobStatus = "succeeded"
+	JobStatusFailed    JobStatus = "failed"
+	JobStatusCancelled JobStatus = "cancelled"
+)
+
+// Job is a unit of background work, such as processing an uploaded video.
+type Job struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Status    JobStatus  `json:"status"`
+	Attempts  int        `json:"attempts"`
+	LastError *string    `json:"last_error"`
+	RunAt     time.Time  `json:"run_at"`
+	LockedAt  *time.Time `json:"locked_at"`
+	// Set when the job should stop; a running job finds out on its next TouchJob
+	CancelRequestedAt *time.Time `json:"cancel_requested_at"`
+	CreateJobParams
+}
+
+type CreateJobParams struct {
+	Kind    string    `json:"kind"`
+	VideoID uuid.UUID `json:"video_id"`
+	// JSON encoded, interpreted by the handler for Kind
+	Payload     string `json:"payload"`
+	MaxAttempts int    `json:"max_attempts"`
+}
+
+const jobColumns = `
+		id,
+		created_at,
+		updated_at,
+		kind,
+		video_id,
+		payload,
+		status,
+		attempts,
+		max_attempts,
+		last_error,
+		run_at,
+		locked_at,
+		cancel_requested_at`
+
+func scanJob(row rowScanner) (Job, error) {
+	var job Job
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.Kind,
+		&job.VideoID,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.LastError,
+		&job.RunAt,
+		&job.LockedAt,
+		&job.CancelRequestedAt,
+	)
+	return job, err
+}
+
+// EnqueueVideoJob moves the job's video to processing and queues the job in a single
+// transaction, so a video is never left processing with nothing queued to process it.
+// It fails with ErrInvalidStatusTransition if the video is already processing.
+func (c Client) EnqueueVideoJob(params CreateJobParams) (Job, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Job{}, err
+	}
+	defer tx.Rollback()
+
+	if err := setVideoStatusFrom(tx, params.VideoID, enqueueSourceStatuses, VideoStatusProcessing, ""); err != nil {
+		return Job{}, err
+	}
+	id, err := enqueueJob(tx, params)
+	if err != nil {
+		return Job{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(id)
+}
+
+func enqueueJob(db execer, params CreateJobParams) (uuid.UUID, error) {
+	id := uuid.New()
+	now := time.Now().UTC()
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		kind,
+		video_id,
+		payload,
+		status,
+		attempts,
+		max_attempts,
+		run_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?, ?)
+	`
+	_, err := db.Exec(query, id, now, now, params.Kind, params.VideoID, params.Payload, JobStatusQueued, params.MaxAttempts, now)
+	return id, err
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE id = ?
+	`
+	return scanJob(c.db.QueryRow(query, id))
+}
+
+// ClaimJob marks the next due job as running and returns it, or nil if no job is due.
+// Users take turns: the job picked belongs to whoever has the fewest jobs running,
+// then whoever started a job longest ago, so one user queueing many videos doesn't
+// hold up everyone else. Among a user's jobs the oldest goes first.
+// The claim is a single statement, so concurrent workers never get the same job,
+// and on PostgreSQL workers on other instances skip jobs being claimed.
+func (c Client) ClaimJob() (*Job, error) {
+	now := time.Now().UTC()
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		locked_at = ?,
+		started_at = ?,
+		updated_at = ?
+	WHERE id = (
+		SELECT j.id FROM jobs j
+		LEFT JOIN videos v ON v.id = j.video_id
+		WHERE j.status = ? AND j.run_at <= ?
+		ORDER BY
+			(
+				SELECT COUNT(*) FROM jobs r
+				JOIN videos rv ON rv.id = r.video_id
+				WHERE r.status = ? AND rv.user_id = v.user_id
+			),
+			(
+				SELECT MAX(s.started_at) FROM jobs s
+				JOIN videos sv ON sv.id = s.video_id
+				WHERE sv.user_id = v.user_id
+			) NULLS FIRST,
+			j.run_at
+		LIMIT 1
+		` + c.db.dialect.skipLocked("j") + `
+	) AND status = ?
+	RETURNING` + jobColumns
+
+	job, err := scanJob(c.db.QueryRow(query, JobStatusRunning, now, now, now, JobStatusQueued, now, JobStatusRunning, JobStatusQueued))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// JobQueueStats counts the jobs waiting and running, both overall and for one user.
+type JobQueueStats struct {
+	Queued int `json:"queued"`
+	// Queued jobs that are due now rather than waiting to be retried
+	Due         int `json:"due"`
+	Running     int `json:"running"`
+	UserQueued  int `json:"user_queued"`
+	UserRunning int `json:"user_running"`
+}
+
+func (c Client) GetJobQueueStats(userID uuid.UUID) (JobQueueStats, error) {
+	query := `
+	SELECT
+		COUNT(*) FILTER (WHERE j.status = ?),
+		COUNT(*) FILTER (WHERE j.status = ? AND j.run_at <= ?),
+		COUNT(*) FILTER (WHERE j.status = ?),
+		COUNT(*) FILTER (WHERE j.status = ? AND v.user_id = ?),
+		COUNT(*) FILTER (WHERE j.status = ? AND v.user_id = ?)
+	FROM jobs j
+	LEFT JOIN videos v ON v.id = j.video_id
+	WHERE j.status IN (?, ?)
+	`
+	var stats JobQueueStats
+	err := c.db.QueryRow(query,
+		JobStatusQueued,
+		JobStatusQueued, time.Now().UTC(),
+		JobStatusRunning,
+		JobStatusQueued, userID,
+		JobStatusRunning, userID,
+		JobStatusQueued, JobStatusRunning,
+	).Scan(&stats.Queued, &stats.Due, &stats.Running, &stats.UserQueued, &stats.UserRunning)
+	return stats, err
+}
+
+// GetActiveJobs returns the jobs that are queued, including ones waiting to be
+// retried, or running.
+func (c Client) GetActiveJobs() ([]Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE status IN (?, ?)
+	`
+	rows, err := c.db.Query(query, JobStatusQueued, JobStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// CountQueuedJobs counts the jobs waiting to run, including ones waiting to be retried.
+func (c Client) CountQueuedJobs() (int, error) {
+	query := `
+	SELECT COUNT(*) FROM jobs
+	WHERE status = ?
+	`
+	var n int
+	err := c.db.QueryRow(query, JobStatusQueued).Scan(&n)
+	return n, err
+}
+
+// TouchJob refreshes the lock on a running job so it isn't considered abandoned,
+// reporting whether the job has been asked to cancel.
+func (c Client) TouchJob(id uuid.UUID) (bool, error) {
+	query := `
+	UPDATE jobs
+	SET locked_at = ?
+	WHERE id = ? AND status = ?
+	RETURNING cancel_requested_at IS NOT NULL
+	`
+	var cancelRequested bool
+	err := c.db.QueryRow(query, time.Now().UTC(), id, JobStatusRunning).Scan(&cancelRequested)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return cancelRequested, err
+}
+
+// CancelVideoJobs cancels a video's queued jobs and asks its running ones to stop,
+// which they notice on their next TouchJob. It returns how many of each it found.
+func (c Client) CancelVideoJobs(videoID uuid.UUID) (queued, running int64, err error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if queued, running, err = cancelVideoJobs(tx, videoID); err != nil {
+		return 0, 0, err
+	}
+	return queued, running, tx.Commit()
+}
+
+func cancelVideoJobs(tx dbTx, videoID uuid.UUID) (queued, running int64, err error) {
+	now := time.Now().UTC()
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = ?,
+		updated_at = ?
+	WHERE video_id = ? AND status = ?
+	`
+	result, err := tx.Exec(query, JobStatusCancelled, "cancelled", now, videoID, JobStatusQueued)
+	if err != nil {
+		return 0, 0, err
+	}
+	if queued, err = result.RowsAffected(); err != nil {
+		return 0, 0, err
+	}
+
+	query = `
+	UPDATE jobs
+	SET
+		cancel_requested_at = ?,
+		updated_at = ?
+	WHERE video_id = ? AND status = ?
+	`
+	result, err = tx.Exec(query, now, now, videoID, JobStatusRunning)
+	if err != nil {
+		return 0, 0, err
+	}
+	if running, err = result.RowsAffected(); err != nil {
+		return 0, 0, err
+	}
+	return queued, running, nil
+}
+
+// CancelJob records that a running job stopped because it was cancelled.
+func (c Client) CancelJob(id uuid.UUID, errMsg string) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = ?,
+		locked_at = NULL,
+		updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusCancelled, errMsg, time.Now().UTC(), id)
+	return err
+}
+
+func (c Client) CompleteJob(id uuid.UUID) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = NULL,
+		locked_at = NULL,
+		updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusSucceeded, time.Now().UTC(), id)
+	return err
+}
+
+// RetryJob puts a failed job back in the queue to run again at runAt.
+func (c Client) RetryJob(id uuid.UUID, errMsg string, runAt time.Time) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = ?,
+		run_at = ?,
+		locked_at = NULL,
+		updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusQueued, errMsg, runAt.UTC(), time.Now().UTC(), id)
+	return err
+}
+
+// FailJob gives up on a job for good.
+func (c Client) FailJob(id uuid.UUID, errMsg string) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = ?,
+		locked_at = NULL,
+		updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusFailed, errMsg, time.Now().UTC(), id)
+	return err
+}
+
+// RequeueStaleJobs returns running jobs whose lock is older than lockedBefore to the
+// queue, e.g. after the server that claimed them crashed.
+func (c Client) RequeueStaleJobs(lockedBefore time.Time) (int64, error) {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		locked_at = NULL,
+		updated_at = ?
+	WHERE status = ? AND locked_at < ?
+	`
+	result, err := c.db.Exec(query, JobStatusQueued, time.Now().UTC(), JobStatusRunning, lockedBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
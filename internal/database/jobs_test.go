@@ -0,0 +1,58 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func newTestClient(t *testing.T) Client {
+	t.Helper()
+	c, err := NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	return c
+}
+
+func newTestVideo(t *testing.T, c Client) Video {
+	t.Helper()
+	user, err := c.CreateUser(CreateUserParams{Email: "user@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("Couldn't create user: %v", err)
+	}
+	video, err := c.CreateVideo(CreateVideoParams{Title: "Test", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("Couldn't create video: %v", err)
+	}
+	return video
+}
+
+func TestEnqueueVideoJobRejectsProcessingVideos(t *testing.T) {
+	c := newTestClient(t)
+	video := newTestVideo(t, c)
+	params := CreateJobParams{Kind: "process_video", VideoID: video.ID, Payload: "{}", MaxAttempts: 5}
+
+	if _, err := c.EnqueueVideoJob(params); err != nil {
+		t.Fatalf("First EnqueueVideoJob: %v", err)
+	}
+	if _, err := c.EnqueueVideoJob(params); !errors.Is(err, ErrInvalidStatusTransition) {
+		t.Errorf("Second EnqueueVideoJob = %v, want ErrInvalidStatusTransition", err)
+	}
+	if queued, err := c.CountQueuedJobs(); err != nil || queued != 1 {
+		t.Errorf("Queued jobs = %d (%v), want 1", queued, err)
+	}
+
+	// The worker still moves its own video to processing when it retries
+	if err := c.SetVideoStatus(video.ID, VideoStatusProcessing, ""); err != nil {
+		t.Errorf("SetVideoStatus(processing) on a processing video: %v", err)
+	}
+
+	// Once processing is over a new job can be queued
+	if err := c.SetVideoStatus(video.ID, VideoStatusReady, ""); err != nil {
+		t.Fatalf("SetVideoStatus(ready): %v", err)
+	}
+	if _, err := c.EnqueueVideoJob(params); err != nil {
+		t.Errorf("EnqueueVideoJob on a ready video: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MediaInfo is what probing a processed video revealed about it.
+type MediaInfo struct {
+	DurationSeconds float64 `json:"duration_seconds"`
+	Width           int     `json:"width"`
+	Height          int     `json:"height"`
+	VideoCodec      string  `json:"video_codec"`
+	// Nil for videos without sound
+	AudioCodec    *string `json:"audio_codec"`
+	AudioChannels int     `json:"audio_channels"`
+	BitRate       int64   `json:"bit_rate"`
+	FrameRate     float64 `json:"frame_rate"`
+	FormatName    string  `json:"format_name"`
+	// EBU R128 integrated loudness in LUFS, measured before any normalization on what
+	// the video was last processed from: the upload, or the cut of it a trim made.
+	// Nil for videos without sound and for silent ones.
+	IntegratedLoudness *float64  `json:"integrated_loudness"`
+	ProbedAt           time.Time `json:"probed_at"`
+}
+
+const mediaInfoColumns = `
+		m.video_id,
+		m.duration_seconds,
+		m.width,
+		m.height,
+		m.video_codec,
+		m.audio_codec,
+		m.audio_channels,
+		m.bit_rate,
+		m.frame_rate,
+		m.format_name,
+		m.integrated_loudness,
+		m.probed_at`
+
+// nullMediaInfo scans the LEFT JOINed media columns of a video, which are all
+// NULL until the video has been processed.
+type nullMediaInfo struct {
+	videoID         sql.NullString
+	durationSeconds sql.NullFloat64
+	width           sql.NullInt64
+	height          sql.NullInt64
+	videoCodec      sql.NullString
+	audioCodec      *string
+	audioChannels   sql.NullInt64
+	bitRate         sql.NullInt64
+	frameRate       sql.NullFloat64
+	formatName      sql.NullString
+	loudness        *float64
+	probedAt        sql.NullTime
+}
+
+func (n *nullMediaInfo) dest() []any {
+	return []any{
+		&n.videoID,
+		&n.durationSeconds,
+		&n.width,
+		&n.height,
+		&n.videoCodec,
+		&n.audioCodec,
+		&n.audioChannels,
+		&n.bitRate,
+		&n.frameRate,
+		&n.formatName,
+		&n.loudness,
+		&n.probedAt,
+	}
+}
+
+func (n *nullMediaInfo) mediaInfo() *MediaInfo {
+	if !n.videoID.Valid {
+		return nil
+	}
+	return &MediaInfo{
+		DurationSeconds:    n.durationSeconds.Float64,
+		Width:              int(n.width.Int64),
+		Height:             int(n.height.Int64),
+		VideoCodec:         n.videoCodec.String,
+		AudioCodec:         n.audioCodec,
+		AudioChannels:      int(n.audioChannels.Int64),
+		BitRate:            n.bitRate.Int64,
+		FrameRate:          n.frameRate.Float64,
+		FormatName:         n.formatName.String,
+		IntegratedLoudness: n.loudness,
+		ProbedAt:           n.probedAt.Time,
+	}
+}
+
+func upsertMediaInfo(tx dbTx, videoID uuid.UUID, info MediaInfo) error {
+	query := `
+	INSERT INTO video_media_info (
+		video_id,
+		duration_seconds,
+		width,
+		height,
+		video_codec,
+		audio_codec,
+		audio_channels,
+		bit_rate,
+		frame_rate,
+		format_name,
+		integrated_loudness,
+		probed_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (video_id) DO UPDATE SET
+		duration_seconds = excluded.duration_seconds,
+		width = excluded.width,
+		height = excluded.height,
+		video_codec = excluded.video_codec,
+		audio_codec = excluded.audio_codec,
+		audio_channels = excluded.audio_channels,
+		bit_rate = excluded.bit_rate,
+		frame_rate = excluded.frame_rate,
+		format_name = excluded.format_name,
+		integrated_loudness = excluded.integrated_loudness,
+		probed_at = excluded.probed_at
+	`
+	_, err := tx.Exec(
+		query,
+		videoID,
+		info.DurationSeconds,
+		info.Width,
+		info.Height,
+		info.VideoCodec,
+		info.AudioCodec,
+		info.AudioChannels,
+		info.BitRate,
+		info.FrameRate,
+		info.FormatName,
+		info.IntegratedLoudness,
+		info.ProbedAt.UTC(),
+	)
+	return err
+}
@@ -0,0 +1,201 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ObjectDeletion is a stored object (or every object under a prefix) that still has
+// to be removed. Rows stay until the deletion succeeds, so failures are retried.
+type ObjectDeletion struct {
+	ID            uuid.UUID `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Attempts      int       `json:"attempts"`
+	LastError     *string   `json:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	ObjectRef
+}
+
+type ObjectRef struct {
+	// Name of the object store the key belongs to
+	Store    string `json:"store"`
+	Key      string `json:"key"`
+	IsPrefix bool   `json:"is_prefix"`
+}
+
+// DeleteVideoAndQueueObjects deletes a video, cancels its jobs like CancelVideoJobs
+// and queues its stored objects for deletion in a single transaction, so metadata
+// and storage can't drift apart.
+func (c Client) DeleteVideoAndQueueObjects(id uuid.UUID, objects []ObjectRef) ([]ObjectDeletion, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	deletions, err := queueObjectDeletions(tx, objects)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := cancelVideoJobs(tx, id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM video_media_info WHERE video_id = ?`, id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM video_captions WHERE video_id = ?`, id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM videos WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return deletions, nil
+}
+
+func (c Client) QueueObjectDeletions(objects []ObjectRef) ([]ObjectDeletion, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	deletions, err := queueObjectDeletions(tx, objects)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return deletions, nil
+}
+
+func queueObjectDeletions(tx dbTx, objects []ObjectRef) ([]ObjectDeletion, error) {
+	query := `
+	INSERT INTO object_deletions (
+		id,
+		created_at,
+		updated_at,
+		store,
+		object_key,
+		is_prefix,
+		attempts,
+		next_attempt_at
+	) VALUES (?, ?, ?, ?, ?, ?, 0, ?)
+	`
+
+	now := time.Now().UTC()
+	deletions := []ObjectDeletion{}
+	for _, obj := range objects {
+		deletion := ObjectDeletion{
+			ID:            uuid.New(),
+			CreatedAt:     now,
+			UpdatedAt:     now,
+			NextAttemptAt: now,
+			ObjectRef:     obj,
+		}
+		_, err := tx.Exec(query, deletion.ID, now, now, obj.Store, obj.Key, obj.IsPrefix, now)
+		if err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, deletion)
+	}
+	return deletions, nil
+}
+
+// GetDueObjectDeletions returns up to limit deletions whose next attempt is due.
+func (c Client) GetDueObjectDeletions(limit int) ([]ObjectDeletion, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		store,
+		object_key,
+		is_prefix,
+		attempts,
+		last_error,
+		next_attempt_at
+	FROM object_deletions
+	WHERE next_attempt_at <= ?
+	ORDER BY next_attempt_at
+	LIMIT ?
+	`
+
+	rows, err := c.db.Query(query, time.Now().UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deletions := []ObjectDeletion{}
+	for rows.Next() {
+		var deletion ObjectDeletion
+		if err := rows.Scan(
+			&deletion.ID,
+			&deletion.CreatedAt,
+			&deletion.UpdatedAt,
+			&deletion.Store,
+			&deletion.Key,
+			&deletion.IsPrefix,
+			&deletion.Attempts,
+			&deletion.LastError,
+			&deletion.NextAttemptAt,
+		); err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, deletion)
+	}
+	return deletions, rows.Err()
+}
+
+// ClaimObjectDeletion pushes a due deletion's next attempt back by lease, reporting
+// whether it was still due. Only the caller that claimed a deletion attempts it, so
+// the inline and the background runs never delete the same objects twice. Should the
+// attempt never be recorded, the deletion is due again once the lease is up.
+func (c Client) ClaimObjectDeletion(id uuid.UUID, lease time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	query := `
+	UPDATE object_deletions
+	SET
+		next_attempt_at = ?,
+		updated_at = ?
+	WHERE id = ? AND next_attempt_at <= ?
+	`
+	result, err := c.db.Exec(query, now.Add(lease), now, id, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (c Client) CompleteObjectDeletion(id uuid.UUID) error {
+	query := `
+	DELETE FROM object_deletions
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
+
+// FailObjectDeletion records a failed attempt and when to try again.
+func (c Client) FailObjectDeletion(id uuid.UUID, errMsg string, nextAttemptAt time.Time) error {
+	query := `
+	UPDATE object_deletions
+	SET
+		attempts = attempts + 1,
+		last_error = ?,
+		next_attempt_at = ?,
+		updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, errMsg, nextAttemptAt.UTC(), time.Now().UTC(), id)
+	return err
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// ThumbnailSrcset lists a thumbnail's resized variants by image type and width in
+// pixels, e.g. {"image/webp": {"320": "https://..."}}. It's stored as JSON text.
+type ThumbnailSrcset map[string]map[int]string
+
+// Add records the URL of the variant of the given type and width.
+func (s ThumbnailSrcset) Add(mediaType string, width int, url string) {
+	if s[mediaType] == nil {
+		s[mediaType] = map[int]string{}
+	}
+	s[mediaType][width] = url
+}
+
+func (s ThumbnailSrcset) Value() (driver.Value, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (s *ThumbnailSrcset) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*s = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("unsupported thumbnail srcset type %T", src)
+	}
+	return json.Unmarshal(data, s)
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type VideoStatus string
+
+const (
+	VideoStatusDraft      VideoStatus = "draft"
+	VideoStatusUploading  VideoStatus = "uploading"
+	VideoStatusProcessing VideoStatus = "processing"
+	VideoStatusReady      VideoStatus = "ready"
+	VideoStatusFailed     VideoStatus = "failed"
+)
+
+var ErrInvalidStatusTransition = errors.New("invalid video status transition")
+
+// videoStatusTransitions lists, for each status, the statuses a video may move to from it.
+var videoStatusTransitions = map[VideoStatus][]VideoStatus{
+	VideoStatusDraft: {VideoStatusUploading, VideoStatusProcessing},
+	// An abandoned upload falls back to whatever the video was before
+	VideoStatusUploading:  {VideoStatusUploading, VideoStatusProcessing, VideoStatusFailed, VideoStatusDraft, VideoStatusReady},
+	VideoStatusProcessing: {VideoStatusProcessing, VideoStatusReady, VideoStatusFailed},
+	VideoStatusReady:      {VideoStatusUploading, VideoStatusProcessing},
+	VideoStatusFailed:     {VideoStatusUploading, VideoStatusProcessing},
+}
+
+func (s VideoStatus) CanTransitionTo(next VideoStatus) bool {
+	for _, allowed := range videoStatusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// SetVideoStatus moves a video to status, failing with ErrInvalidStatusTransition if its
+// current status doesn't allow that. statusErr is kept for VideoStatusFailed, and for
+// VideoStatusReady when set, where it says why the latest processing didn't take effect.
+func (c Client) SetVideoStatus(id uuid.UUID, status VideoStatus, statusErr string) error {
+	return setVideoStatus(c.db, id, status, statusErr)
+}
+
+func setVideoStatus(db execer, id uuid.UUID, status VideoStatus, statusErr string) error {
+	from := []VideoStatus{}
+	for current := range videoStatusTransitions {
+		if current.CanTransitionTo(status) {
+			from = append(from, current)
+		}
+	}
+	return setVideoStatusFrom(db, id, from, status, statusErr)
+}
+
+// enqueueSourceStatuses are the statuses a job may be queued for a video from. Unlike
+// the worker moving its own video to processing again on a retry, a video that is
+// already processing can't have a second job queued, which would race the first.
+var enqueueSourceStatuses = []VideoStatus{VideoStatusDraft, VideoStatusUploading, VideoStatusReady, VideoStatusFailed}
+
+// setVideoStatusFrom moves a video to status if its current status is one of from.
+func setVideoStatusFrom(db execer, id uuid.UUID, from []VideoStatus, status VideoStatus, statusErr string) error {
+	if len(from) == 0 {
+		return ErrInvalidStatusTransition
+	}
+
+	var errMsg *string
+	if status == VideoStatusFailed || (status == VideoStatusReady && statusErr != "") {
+		errMsg = &statusErr
+	}
+
+	// The allowed source statuses are part of the WHERE clause, so a concurrent
+	// change can't slip in between checking and updating
+	now := time.Now().UTC()
+	query := `
+	UPDATE videos
+	SET
+		status = ?,
+		status_error = ?,
+		status_updated_at = ?,
+		processing_started_at = CASE WHEN ? THEN ? ELSE processing_started_at END,
+		ready_at = CASE WHEN ? THEN ? ELSE ready_at END,
+		updated_at = ?
+	WHERE id = ? AND status IN (?` + strings.Repeat(", ?", len(from)-1) + `)
+	`
+	args := []any{
+		status,
+		errMsg,
+		now,
+		status == VideoStatusProcessing, now,
+		status == VideoStatusReady, now,
+		now,
+		id,
+	}
+	for _, current := range from {
+		args = append(args, current)
+	}
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvalidStatusTransition
+	}
+	return nil
+}
+
+// ExpireVideoUploads takes videos that have been uploading since before olderThan
+// with no job queued or running for them out of uploading: back to ready if an
+// earlier upload is published, otherwise to draft. An upload that still completes
+// afterwards is queued for processing as usual. It returns how many videos it reset.
+func (c Client) ExpireVideoUploads(olderThan time.Time) (int64, error) {
+	now := time.Now().UTC()
+	query := `
+	UPDATE videos
+	SET
+		status = CASE WHEN video_url IS NULL THEN ? ELSE ? END,
+		status_error = NULL,
+		status_updated_at = ?,
+		updated_at = ?
+	WHERE status = ? AND status_updated_at < ? AND NOT EXISTS (
+		SELECT 1 FROM jobs
+		WHERE jobs.video_id = videos.id AND jobs.status IN (?, ?)
+	)
+	`
+	result, err := c.db.Exec(query,
+		VideoStatusDraft, VideoStatusReady,
+		now, now,
+		VideoStatusUploading, olderThan.UTC(),
+		JobStatusQueued, JobStatusRunning,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
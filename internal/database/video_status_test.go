@@ -0,0 +1,58 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestExpireVideoUploads(t *testing.T) {
+	c := newTestClient(t)
+	user, err := c.CreateUser(CreateUserParams{Email: "user@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("Couldn't create user: %v", err)
+	}
+	newVideo := func(status VideoStatus, published bool) uuid.UUID {
+		t.Helper()
+		video, err := c.CreateVideo(CreateVideoParams{Title: "Test", UserID: user.ID})
+		if err != nil {
+			t.Fatalf("Couldn't create video: %v", err)
+		}
+		if published {
+			if err := c.SetVideoOutputs(video.ID, VideoOutputs{VideoURL: "http://localhost/v.mp4"}); err != nil {
+				t.Fatalf("Couldn't publish video: %v", err)
+			}
+		}
+		if err := c.SetVideoStatus(video.ID, status, ""); err != nil {
+			t.Fatalf("Couldn't set status: %v", err)
+		}
+		return video.ID
+	}
+
+	draft := newVideo(VideoStatusUploading, false)
+	published := newVideo(VideoStatusUploading, true)
+	processing := newVideo(VideoStatusProcessing, false)
+
+	// Nothing has been uploading for long enough yet
+	if n, err := c.ExpireVideoUploads(time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("ExpireVideoUploads = %d (%v), want 0", n, err)
+	}
+
+	if n, err := c.ExpireVideoUploads(time.Now().Add(time.Minute)); err != nil || n != 2 {
+		t.Fatalf("ExpireVideoUploads = %d (%v), want 2", n, err)
+	}
+	for id, want := range map[uuid.UUID]VideoStatus{
+		draft:      VideoStatusDraft,
+		published:  VideoStatusReady,
+		processing: VideoStatusProcessing,
+	} {
+		video, err := c.GetVideo(id)
+		if err != nil {
+			t.Fatalf("Couldn't get video: %v", err)
+		}
+		if video.Status != want {
+			t.Errorf("Status = %q, want %q", video.Status, want)
+		}
+	}
+}
@@ -13,7 +13,34 @@ type Video struct {
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	// Resized variants of the thumbnail for srcset, nil for thumbnails stored before they existed
+	ThumbnailSrcset ThumbnailSrcset `json:"thumbnail_srcset"`
+	VideoURL        *string         `json:"video_url"`
+	// Master playlist of the HLS renditions
+	HLSURL *string `json:"hls_url"`
+	// MPEG-DASH manifest of the same renditions, if DASH packaging is enabled
+	DASHURL *string `json:"dash_url"`
+	// Audio-only AAC (.m4a) or MP3 rendition, nil for videos without sound
+	AudioURL *string `json:"audio_url"`
+	// Upload the published video was made from, kept privately in the video store
+	// so it can be processed again, e.g. with a different watermark
+	OriginalKey *string `json:"-"`
+	// Short animated WebP (or GIF) clip for hover previews
+	PreviewURL *string `json:"preview_url"`
+	// WebVTT track pointing into sprite sheets of frames, for seek bar thumbnails
+	ThumbnailTrackURL *string `json:"thumbnail_track_url"`
+	// "16:9", "9:16", "4:3", "1:1", "21:9", "4:5" or "other", set once processed
+	AspectRatio *string     `json:"aspect_ratio"`
+	Status      VideoStatus `json:"status"`
+	// Why processing failed, only set when Status is VideoStatusFailed
+	StatusError         *string    `json:"status_error"`
+	StatusUpdatedAt     *time.Time `json:"status_updated_at"`
+	ProcessingStartedAt *time.Time `json:"processing_started_at"`
+	ReadyAt             *time.Time `json:"ready_at"`
+	// Nil until the video has been processed
+	Media *MediaInfo `json:"media"`
+	// Ordered by language
+	Captions []CaptionTrack `json:"captions"`
 	CreateVideoParams
 }
 
@@ -23,23 +50,89 @@ type CreateVideoParams struct {
 	UserID      uuid.UUID `json:"user_id"`
 }
 
+const videoColumns = `
+		v.id,
+		v.created_at,
+		v.updated_at,
+		v.title,
+		v.description,
+		v.thumbnail_url,
+		v.thumbnail_srcset,
+		v.video_url,
+		v.hls_url,
+		v.dash_url,
+		v.audio_url,
+		v.original_key,
+		v.preview_url,
+		v.thumbnail_track_url,
+		v.aspect_ratio,
+		v.user_id,
+		v.status,
+		v.status_error,
+		v.status_updated_at,
+		v.processing_started_at,
+		v.ready_at,` + mediaInfoColumns
+
+// videoTables joins the optional media info onto each video
+const videoTables = `
+	FROM videos v
+	LEFT JOIN video_media_info m ON m.video_id = v.id`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	var media nullMediaInfo
+	dest := []any{
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.ThumbnailSrcset,
+		&video.VideoURL,
+		&video.HLSURL,
+		&video.DASHURL,
+		&video.AudioURL,
+		&video.OriginalKey,
+		&video.PreviewURL,
+		&video.ThumbnailTrackURL,
+		&video.AspectRatio,
+		&video.UserID,
+		&video.Status,
+		&video.StatusError,
+		&video.StatusUpdatedAt,
+		&video.ProcessingStartedAt,
+		&video.ReadyAt,
+	}
+	err := row.Scan(append(dest, media.dest()...)...)
+	video.Media = media.mediaInfo()
+	return video, err
+}
+
 func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
+	SELECT` + videoColumns + videoTables + `
+	WHERE v.user_id = ?
+	ORDER BY v.created_at DESC
 	`
+	return c.queryVideos(query, userID)
+}
 
-	rows, err := c.db.Query(query, userID)
+// GetAllVideos returns every user's videos, for maintenance jobs.
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + videoTables + `
+	ORDER BY v.created_at
+	`
+	return c.queryVideos(query)
+}
+
+func (c Client) queryVideos(query string, args ...any) ([]Video, error) {
+	rows, err := c.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,22 +140,19 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
+	if err := c.attachCaptions(videos); err != nil {
+		return nil, err
+	}
 	return videos, nil
 }
 
@@ -88,29 +178,11 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
-	WHERE id = ?
+	SELECT` + videoColumns + videoTables + `
+	WHERE v.id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -118,38 +190,97 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 		return Video{}, err
 	}
 
-	return video, nil
+	videos := []Video{video}
+	if err := c.attachCaptions(videos); err != nil {
+		return Video{}, err
+	}
+	return videos[0], nil
 }
 
-func (c Client) UpdateVideo(video Video) error {
+// VideoOutputs are the results of processing an uploaded video.
+type VideoOutputs struct {
+	VideoURL string
+	HLSURL   *string
+	DASHURL  *string
+	AudioURL *string
+	// Key of the upload the outputs were made from
+	OriginalKey *string
+	// nil when previews are disabled or couldn't be generated
+	PreviewURL        *string
+	ThumbnailTrackURL *string
+	AspectRatio       string
+	Media             *MediaInfo
+}
+
+// SetVideoOutputs only touches the processing results, so background processing
+// can't overwrite changes the user made to the video in the meantime.
+func (c Client) SetVideoOutputs(id uuid.UUID, outputs VideoOutputs) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `
 	UPDATE videos
 	SET
-		title = ?,
-		description = ?,
-		thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
+		hls_url = ?,
+		dash_url = ?,
+		audio_url = ?,
+		original_key = ?,
+		preview_url = ?,
+		thumbnail_track_url = ?,
+		aspect_ratio = ?,
+		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
 	`
+	_, err = tx.Exec(query, outputs.VideoURL, outputs.HLSURL, outputs.DASHURL, outputs.AudioURL, outputs.OriginalKey, outputs.PreviewURL, outputs.ThumbnailTrackURL, outputs.AspectRatio, id)
+	if err != nil {
+		return err
+	}
 
-	_, err := c.db.Exec(
-		query,
-		video.Title,
-		video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		video.UserID,
-		video.ID,
-	)
-	return err
+	if outputs.Media != nil {
+		if err := upsertMediaInfo(tx, id, *outputs.Media); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
+// SetVideoThumbnail only touches the thumbnail columns, so a thumbnail upload can't
+// revert processing results saved while the thumbnail was being stored.
+func (c Client) SetVideoThumbnail(id uuid.UUID, thumbnailURL string, srcset ThumbnailSrcset) error {
 	query := `
-	DELETE FROM videos
+	UPDATE videos
+	SET
+		thumbnail_url = ?,
+		thumbnail_srcset = ?,
+		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err := c.db.Exec(query, thumbnailURL, srcset, id)
 	return err
 }
+
+// SetVideoThumbnailIfUnset sets thumbnail_url and thumbnail_srcset unless the video
+// already has a thumbnail, reporting whether it did.
+func (c Client) SetVideoThumbnailIfUnset(id uuid.UUID, thumbnailURL string, srcset ThumbnailSrcset) (bool, error) {
+	query := `
+	UPDATE videos
+	SET
+		thumbnail_url = ?,
+		thumbnail_srcset = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND thumbnail_url IS NULL
+	`
+	result, err := c.db.Exec(query, thumbnailURL, srcset, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
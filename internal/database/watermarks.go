@@ -0,0 +1,120 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Watermark is a user's logo, overlaid on their videos while they're processed.
+type Watermark struct {
+	UserID   uuid.UUID `json:"user_id"`
+	ImageURL string    `json:"image_url"`
+	// "top-left", "top-right", "bottom-left", "bottom-right" or "center"
+	Position string `json:"position"`
+	// 0 (invisible) to 1 (opaque)
+	Opacity float64 `json:"opacity"`
+	// Width of the image as a fraction of the video's width
+	Scale     float64   `json:"scale"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const watermarkColumns = `
+		user_id,
+		image_url,
+		position,
+		opacity,
+		scale,
+		created_at,
+		updated_at`
+
+func scanWatermark(row rowScanner) (Watermark, error) {
+	var watermark Watermark
+	err := row.Scan(
+		&watermark.UserID,
+		&watermark.ImageURL,
+		&watermark.Position,
+		&watermark.Opacity,
+		&watermark.Scale,
+		&watermark.CreatedAt,
+		&watermark.UpdatedAt,
+	)
+	return watermark, err
+}
+
+// GetWatermark returns a user's watermark, or nil if they haven't set one.
+func (c Client) GetWatermark(userID uuid.UUID) (*Watermark, error) {
+	query := `
+	SELECT` + watermarkColumns + `
+	FROM watermarks
+	WHERE user_id = ?
+	`
+	watermark, err := scanWatermark(c.db.QueryRow(query, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &watermark, nil
+}
+
+// GetWatermarks returns every user's watermark.
+func (c Client) GetWatermarks() ([]Watermark, error) {
+	query := `
+	SELECT` + watermarkColumns + `
+	FROM watermarks
+	ORDER BY user_id
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watermarks := []Watermark{}
+	for rows.Next() {
+		watermark, err := scanWatermark(rows)
+		if err != nil {
+			return nil, err
+		}
+		watermarks = append(watermarks, watermark)
+	}
+	return watermarks, rows.Err()
+}
+
+// SetWatermark adds watermark.UserID's watermark or replaces the existing one.
+func (c Client) SetWatermark(watermark Watermark) error {
+	now := time.Now().UTC()
+	query := `
+	INSERT INTO watermarks (
+		user_id,
+		image_url,
+		position,
+		opacity,
+		scale,
+		created_at,
+		updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (user_id) DO UPDATE SET
+		image_url = excluded.image_url,
+		position = excluded.position,
+		opacity = excluded.opacity,
+		scale = excluded.scale,
+		updated_at = excluded.updated_at
+	`
+	_, err := c.db.Exec(query, watermark.UserID, watermark.ImageURL, watermark.Position, watermark.Opacity, watermark.Scale, now, now)
+	return err
+}
+
+func (c Client) DeleteWatermark(userID uuid.UUID) error {
+	query := `
+	DELETE FROM watermarks
+	WHERE user_id = ?
+	`
+	_, err := c.db.Exec(query, userID)
+	return err
+}
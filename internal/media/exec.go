@@ -0,0 +1,594 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minMajorVersion is the oldest ffmpeg release with everything used here, such
+// as HLS variant streams and -progress out_time_us.
+const minMajorVersion = 4
+
+// ExecProcessor runs the ffmpeg and ffprobe binaries.
+type ExecProcessor struct {
+	ffmpegPath  string
+	ffprobePath string
+}
+
+// NewExecProcessor uses the given binaries, which are looked up in PATH unless
+// they contain a slash.
+func NewExecProcessor(ffmpegPath, ffprobePath string) *ExecProcessor {
+	return &ExecProcessor{ffmpegPath: ffmpegPath, ffprobePath: ffprobePath}
+}
+
+// CheckVersions makes sure both binaries run and are recent enough, returning
+// the versions they report.
+func (p *ExecProcessor) CheckVersions(ctx context.Context) (ffmpegVersion, ffprobeVersion string, err error) {
+	ffmpegVersion, err = checkVersion(ctx, p.ffmpegPath)
+	if err != nil {
+		return "", "", err
+	}
+	ffprobeVersion, err = checkVersion(ctx, p.ffprobePath)
+	if err != nil {
+		return "", "", err
+	}
+	return ffmpegVersion, ffprobeVersion, nil
+}
+
+func checkVersion(ctx context.Context, binary string) (string, error) {
+	output, err := exec.CommandContext(ctx, binary, "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("error running %s: %w", binary, err)
+	}
+
+	// "ffmpeg version 6.1.1-3ubuntu5 Copyright (c) ...", or "n6.1" and
+	// "N-113000-g..." for builds from git
+	firstLine, _, _ := strings.Cut(string(output), "\n")
+	_, rest, found := strings.Cut(firstLine, " version ")
+	if !found {
+		return "", fmt.Errorf("unexpected %s -version output: %q", binary, firstLine)
+	}
+	version, _, _ := strings.Cut(rest, " ")
+
+	majorStr, _, _ := strings.Cut(strings.TrimPrefix(version, "n"), ".")
+	major, err := strconv.Atoi(majorStr)
+	if err != nil {
+		// Git snapshots have no release number, but are newer than any release we need
+		return version, nil
+	}
+	if major < minMajorVersion {
+		return "", fmt.Errorf("%s %s is too old, at least version %d is needed", binary, version, minMajorVersion)
+	}
+	return version, nil
+}
+
+func (p *ExecProcessor) Probe(ctx context.Context, path string) (Probe, error) {
+	cmd := exec.CommandContext(ctx, p.ffprobePath, "-v", "error", "-print_format", "json", "-show_streams", "-show_format", path)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && ctx.Err() == nil {
+			return Probe{}, fmt.Errorf("%w: ffprobe error: %v: %s", ErrInvalidMedia, err, lastLines(stderr.Bytes(), 5))
+		}
+		return Probe{}, fmt.Errorf("ffprobe error: %w", err)
+	}
+
+	var output struct {
+		Streams []struct {
+			CodecType    string `json:"codec_type"`
+			CodecName    string `json:"codec_name"`
+			Width        int    `json:"width"`
+			Height       int    `json:"height"`
+			AvgFrameRate string `json:"avg_frame_rate"`
+			RFrameRate   string `json:"r_frame_rate"`
+			Channels     int    `json:"channels"`
+			// "N:D", or "0:1" when unknown
+			SampleAspectRatio string `json:"sample_aspect_ratio"`
+			// Older muxers tag rotation instead of writing a display matrix
+			Tags struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+			SideDataList []struct {
+				SideDataType string  `json:"side_data_type"`
+				Rotation     float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+			BitRate    string `json:"bit_rate"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return Probe{}, fmt.Errorf("%w: error parsing ffprobe output: %v", ErrInvalidMedia, err)
+	}
+
+	probe := Probe{
+		FormatName: output.Format.FormatName,
+	}
+	foundVideo := false
+	for _, stream := range output.Streams {
+		switch stream.CodecType {
+		case "video":
+			if foundVideo {
+				continue
+			}
+			foundVideo = true
+			probe.Width = stream.Width
+			probe.Height = stream.Height
+			probe.VideoCodec = stream.CodecName
+			probe.FrameRate = parseFrameRate(stream.AvgFrameRate)
+			if probe.FrameRate == 0 {
+				probe.FrameRate = parseFrameRate(stream.RFrameRate)
+			}
+			probe.SampleAspectRatio = parseSampleAspectRatio(stream.SampleAspectRatio)
+			rotation, _ := strconv.ParseFloat(stream.Tags.Rotate, 64)
+			for _, sideData := range stream.SideDataList {
+				if sideData.SideDataType == "Display Matrix" {
+					// The display matrix rotates counter-clockwise, the tag clockwise
+					rotation = -sideData.Rotation
+				}
+			}
+			probe.Rotation = normalizeRotation(rotation)
+		case "audio":
+			if probe.HasAudio {
+				continue
+			}
+			probe.HasAudio = true
+			probe.AudioCodec = stream.CodecName
+			probe.AudioChannels = stream.Channels
+		}
+	}
+	if !foundVideo {
+		return Probe{}, fmt.Errorf("%w: no video streams found in ffprobe output", ErrInvalidMedia)
+	}
+
+	// Duration and bit rate are missing for some containers; they're informational only
+	probe.DurationSeconds, _ = strconv.ParseFloat(output.Format.Duration, 64)
+	probe.BitRate, _ = strconv.ParseInt(output.Format.BitRate, 10, 64)
+	return probe, nil
+}
+
+func (p *ExecProcessor) FastStart(ctx context.Context, src, dst string, progress Progress) error {
+	args := []string{"-y", "-i", src, "-c", "copy", "-movflags", "faststart", "-f", "mp4", dst}
+	if err := p.runWithProgress(ctx, args, progress); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("ffmpeg error: %w", err)
+	}
+	return nil
+}
+
+func (p *ExecProcessor) Transcode(ctx context.Context, src, dst string, opts TranscodeOptions, progress Progress) error {
+	args := []string{"-y"}
+	// Seeking the input is fast, and exact when re-encoding
+	if opts.Start > 0 {
+		args = append(args, "-ss", formatSeconds(opts.Start))
+	}
+	args = append(args, "-i", src)
+	if opts.Watermark != nil && opts.VideoCodec != "" {
+		args = append(args, "-i", opts.Watermark.ImagePath)
+	}
+	if opts.End > 0 {
+		args = append(args, "-t", formatSeconds(opts.End-opts.Start))
+	}
+	if opts.Start > 0 && (opts.VideoCodec == "copy" || opts.AudioCodec == "copy") {
+		// Copied packets keep their timestamps, so shift them back to 0
+		args = append(args, "-avoid_negative_ts", "make_zero")
+	}
+	switch {
+	case opts.VideoCodec != "" && opts.Watermark != nil:
+		args = append(args, "-filter_complex", watermarkFilter(opts.VideoFilter, *opts.Watermark), "-map", "[v]", "-c:v", opts.VideoCodec)
+	case opts.VideoCodec != "":
+		args = append(args, "-map", "0:v:0", "-c:v", opts.VideoCodec)
+		if opts.VideoFilter != "" {
+			args = append(args, "-vf", opts.VideoFilter)
+		}
+	}
+	if opts.VideoCodec != "" && opts.VideoCodec != "copy" {
+		if opts.Preset != "" {
+			args = append(args, "-preset", opts.Preset)
+		}
+		if opts.Profile != "" {
+			args = append(args, "-profile:v", opts.Profile)
+		}
+		if opts.VideoBitrate != "" {
+			args = append(args, "-b:v", opts.VideoBitrate)
+			if opts.MaxRate != "" {
+				args = append(args, "-maxrate", opts.MaxRate, "-bufsize", opts.BufSize)
+			}
+		} else if opts.CRF > 0 {
+			args = append(args, "-crf", strconv.Itoa(opts.CRF))
+		}
+		if opts.GOP > 0 {
+			gop := strconv.Itoa(opts.GOP)
+			args = append(args, "-g", gop, "-keyint_min", gop, "-sc_threshold", "0")
+		}
+		if opts.PixelFormat != "" {
+			args = append(args, "-pix_fmt", opts.PixelFormat)
+		}
+	}
+
+	if opts.AudioCodec != "" {
+		args = append(args, "-map", "0:a:0", "-c:a", opts.AudioCodec)
+		if opts.AudioCodec != "copy" {
+			if opts.AudioBitrate != "" {
+				args = append(args, "-b:a", opts.AudioBitrate)
+			}
+			if opts.AudioChannels > 0 {
+				args = append(args, "-ac", strconv.Itoa(opts.AudioChannels))
+			}
+			if opts.AudioFilter != "" {
+				args = append(args, "-af", opts.AudioFilter)
+			}
+		}
+	}
+	if opts.FastStart {
+		args = append(args, "-movflags", "faststart")
+	}
+	format := "mp4"
+	if filepath.Ext(dst) == ".mp3" {
+		format = "mp3"
+	}
+	args = append(args, "-f", format, dst)
+
+	if err := p.runWithProgress(ctx, args, progress); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("ffmpeg error transcoding: %w", err)
+	}
+	return nil
+}
+
+// watermarkFilter builds a filter graph applying videoFilter to the first input and
+// then overlaying the second, the watermark image, which is scaled relative to the
+// video and kept a small margin away from its edges.
+func watermarkFilter(videoFilter string, w Watermark) string {
+	graph := ""
+	base := "[0:v]"
+	if videoFilter != "" {
+		graph = "[0:v]" + videoFilter + "[src];"
+		base = "[src]"
+	}
+
+	margin := "W*0.03"
+	x, y := "W-w-"+margin, "H-h-"+margin
+	switch w.Position {
+	case "top-left":
+		x, y = margin, margin
+	case "top-right":
+		y = margin
+	case "bottom-left":
+		x = margin
+	case "center":
+		x, y = "(W-w)/2", "(H-h)/2"
+	}
+
+	return graph + fmt.Sprintf(
+		"[1:v]format=rgba,colorchannelmixer=aa=%.2f[logo];[logo]%sscale2ref=w=main_w*%.3f:h=ow/a[logo][base];[base][logo]overlay=x=%s:y=%s[v]",
+		w.Opacity, base, w.Scale, x, y)
+}
+
+// loudnormStats is the part of loudnorm's print_format=json report MeasureLoudness
+// uses. The numbers come as strings, which can be "-inf".
+type loudnormStats struct {
+	InputI      string `json:"input_i"`
+	InputTP     string `json:"input_tp"`
+	InputLRA    string `json:"input_lra"`
+	InputThresh string `json:"input_thresh"`
+}
+
+func (p *ExecProcessor) MeasureLoudness(ctx context.Context, path string, progress Progress) (Loudness, error) {
+	args := []string{"-i", path, "-map", "0:a:0", "-af", "loudnorm=print_format=json", "-f", "null", "-"}
+	output, err := p.runWithProgressOutput(ctx, args, progress)
+	if err != nil {
+		return Loudness{}, fmt.Errorf("ffmpeg error measuring loudness: %w", err)
+	}
+
+	// The report is the last thing loudnorm logs
+	start := bytes.LastIndexByte(output, '{')
+	end := bytes.LastIndexByte(output, '}')
+	if start < 0 || end < start {
+		return Loudness{}, errors.New("ffmpeg didn't report loudness")
+	}
+	var stats loudnormStats
+	if err := json.Unmarshal(output[start:end+1], &stats); err != nil {
+		return Loudness{}, fmt.Errorf("error decoding loudness report: %w", err)
+	}
+
+	values := []float64{}
+	for _, s := range []string{stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh} {
+		value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return Loudness{}, fmt.Errorf("error decoding loudness report: %w", err)
+		}
+		values = append(values, value)
+	}
+	return Loudness{Integrated: values[0], TruePeak: values[1], Range: values[2], Threshold: values[3]}, nil
+}
+
+func (p *ExecProcessor) Keyframes(ctx context.Context, path string) ([]time.Duration, error) {
+	// Reading packet flags is much faster than decoding frames
+	cmd := exec.CommandContext(ctx, p.ffprobePath,
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,flags",
+		"-of", "csv=p=0",
+		path,
+	)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && ctx.Err() == nil {
+			return nil, fmt.Errorf("%w: ffprobe error: %v: %s", ErrInvalidMedia, err, lastLines(stderr.Bytes(), 5))
+		}
+		return nil, fmt.Errorf("ffprobe error: %w", err)
+	}
+
+	// One "1.234000,K__" line per packet, with the packets in decoding order
+	keyframes := []time.Duration{}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		ptsTime, flags, _ := strings.Cut(strings.TrimSpace(line), ",")
+		if !strings.HasPrefix(flags, "K") {
+			continue
+		}
+		seconds, err := strconv.ParseFloat(ptsTime, 64)
+		if err != nil {
+			continue
+		}
+		keyframes = append(keyframes, time.Duration(seconds*float64(time.Second)))
+	}
+	slices.Sort(keyframes)
+	return keyframes, nil
+}
+
+func (p *ExecProcessor) ExtractFrame(ctx context.Context, src, dst string, opts FrameOptions) error {
+	args := []string{"-y"}
+	if opts.Offset > 0 {
+		args = append(args, "-ss", formatSeconds(opts.Offset))
+	}
+	args = append(args, "-i", src)
+	if opts.VideoFilter != "" {
+		args = append(args, "-vf", opts.VideoFilter)
+	}
+	args = append(args, "-frames:v", "1")
+	if opts.Quality > 0 {
+		args = append(args, "-q:v", strconv.Itoa(opts.Quality))
+	}
+	args = append(args, dst)
+
+	if err := p.run(ctx, args); err != nil {
+		return fmt.Errorf("ffmpeg error extracting frame: %w", err)
+	}
+
+	// ffmpeg succeeds without writing anything when no frame matched
+	if info, err := os.Stat(dst); err != nil || info.Size() == 0 {
+		return ErrNoFrame
+	}
+	return nil
+}
+
+func (p *ExecProcessor) AnimatedPreview(ctx context.Context, src, dst string, opts PreviewOptions) error {
+	filter := fmt.Sprintf("fps=%d,scale=%d:-2:flags=lanczos", opts.FPS, opts.Width)
+	args := []string{"-y", "-ss", formatSeconds(opts.Start), "-t", formatSeconds(opts.Duration), "-i", src, "-an"}
+	switch filepath.Ext(dst) {
+	case ".gif":
+		// GIF has 256 colours, so build a palette from the clip itself
+		args = append(args, "-vf", filter+",split[a][b];[a]palettegen[p];[b][p]paletteuse")
+	default:
+		args = append(args, "-vf", filter, "-quality", "60")
+	}
+	args = append(args, "-loop", "0", dst)
+
+	if err := p.run(ctx, args); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("ffmpeg error creating preview: %w", err)
+	}
+	return nil
+}
+
+func (p *ExecProcessor) SpriteSheets(ctx context.Context, src, dstPattern string, opts SpriteOptions) error {
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d,tile=%dx%d",
+		formatSeconds(opts.Interval), opts.Width, opts.Height, opts.Columns, opts.Rows)
+	args := []string{"-y", "-i", src, "-an", "-vf", filter, "-q:v", "5", "-start_number", "0", dstPattern}
+
+	if err := p.run(ctx, args); err != nil {
+		return fmt.Errorf("ffmpeg error creating sprite sheets: %w", err)
+	}
+	return nil
+}
+
+func (p *ExecProcessor) PackageHLS(ctx context.Context, renditions []Rendition, outDir string, opts PackageOptions) (string, error) {
+	const masterPlaylist = "master.m3u8"
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return "", fmt.Errorf("error creating HLS directory: %w", err)
+	}
+
+	args := []string{"-y"}
+	for _, r := range renditions {
+		args = append(args, "-i", r.Path)
+	}
+	streamMap := []string{}
+	for i, r := range renditions {
+		args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+		entry := fmt.Sprintf("v:%d", i)
+		if opts.HasAudio {
+			args = append(args, "-map", fmt.Sprintf("%d:a:0", i))
+			entry += fmt.Sprintf(",a:%d", i)
+		}
+		streamMap = append(streamMap, entry+",name:"+r.Name)
+	}
+	args = append(args,
+		"-c", "copy",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(opts.SegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outDir, "%v", "segment_%03d.ts"),
+		"-master_pl_name", masterPlaylist,
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(outDir, "%v", "playlist.m3u8"),
+	)
+
+	if err := p.run(ctx, args); err != nil {
+		return "", fmt.Errorf("ffmpeg error packaging HLS: %w", err)
+	}
+	return masterPlaylist, nil
+}
+
+func (p *ExecProcessor) PackageDASH(ctx context.Context, renditions []Rendition, outDir string, opts PackageOptions) (string, error) {
+	const manifest = "manifest.mpd"
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return "", fmt.Errorf("error creating DASH directory: %w", err)
+	}
+
+	args := []string{"-y"}
+	for _, r := range renditions {
+		args = append(args, "-i", r.Path)
+	}
+	for i := range renditions {
+		args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+	}
+	adaptationSets := "id=0,streams=v"
+	if opts.HasAudio {
+		args = append(args, "-map", "0:a:0")
+		adaptationSets += " id=1,streams=a"
+	}
+	args = append(args,
+		"-c", "copy",
+		"-f", "dash",
+		"-seg_duration", strconv.Itoa(opts.SegmentSeconds),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		"-adaptation_sets", adaptationSets,
+		filepath.Join(outDir, manifest),
+	)
+
+	if err := p.run(ctx, args); err != nil {
+		return "", fmt.Errorf("ffmpeg error packaging DASH: %w", err)
+	}
+	return manifest, nil
+}
+
+// run runs ffmpeg, including the end of its output in the error if it fails.
+func (p *ExecProcessor) run(ctx context.Context, args []string) error {
+	cmd := exec.CommandContext(ctx, p.ffmpegPath, args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, lastLines(output, 5))
+	}
+	return nil
+}
+
+// runWithProgress is run, reading ffmpeg's -progress output to report how much
+// of the input has been processed.
+func (p *ExecProcessor) runWithProgress(ctx context.Context, args []string, progress Progress) error {
+	_, err := p.runWithProgressOutput(ctx, args, progress)
+	return err
+}
+
+// runWithProgressOutput is runWithProgress, also returning what ffmpeg logged.
+func (p *ExecProcessor) runWithProgressOutput(ctx context.Context, args []string, progress Progress) ([]byte, error) {
+	// -progress is a global option, so it has to come before the output file
+	args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	cmd := exec.CommandContext(ctx, p.ffmpegPath, args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		// Despite the name, out_time_ms is in microseconds too
+		case "out_time_us", "out_time_ms":
+			us, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && progress.DurationSeconds > 0 {
+				progress.report(float64(us) / 1e6 / progress.DurationSeconds)
+			}
+		case "progress":
+			if value == "end" {
+				progress.report(1)
+			}
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, lastLines(stderr.Bytes(), 5))
+	}
+	return stderr.Bytes(), nil
+}
+
+// formatSeconds formats d for ffmpeg's time options.
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// lastLines trims ffmpeg's chatty output down to the part that explains a failure.
+func lastLines(output []byte, n int) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseFrameRate parses ffprobe's rational frame rates such as "30000/1001".
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// parseSampleAspectRatio parses ffprobe's "N:D" sample aspect ratios, treating
+// unknown or invalid ones as square pixels.
+func parseSampleAspectRatio(sar string) float64 {
+	ratio := parseFrameRate(strings.Replace(sar, ":", "/", 1))
+	if ratio <= 0 {
+		return 1
+	}
+	return ratio
+}
+
+// normalizeRotation rounds a rotation to the nearest quarter turn in [0, 360).
+func normalizeRotation(degrees float64) int {
+	quarterTurns := int(math.Round(degrees / 90))
+	return ((quarterTurns%4 + 4) % 4) * 90
+}
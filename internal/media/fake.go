@@ -0,0 +1,227 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FakeProcessor stands in for ffmpeg without running anything. Every input probes
+// as Result, and outputs are copies of the input or small placeholder files. It is
+// meant for tests and for running the server where ffmpeg isn't installed.
+type FakeProcessor struct {
+	// What Probe reports for any non-empty file
+	Result Probe
+	// Makes the operation of the same name, e.g. "Transcode", fail
+	Errors map[string]error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+// NewFakeProcessor probes every file as ten seconds of 1080p H.264/AAC MP4.
+func NewFakeProcessor() *FakeProcessor {
+	return &FakeProcessor{
+		Result: Probe{
+			Width:             1920,
+			Height:            1080,
+			SampleAspectRatio: 1,
+			DurationSeconds:   10,
+			VideoCodec:        "h264",
+			HasAudio:          true,
+			AudioCodec:        "aac",
+			AudioChannels:     2,
+			BitRate:           5_000_000,
+			FrameRate:         30,
+			FormatName:        "mov,mp4,m4a,3gp,3g2,mj2",
+		},
+		Errors: map[string]error{},
+	}
+}
+
+// Calls lists the operations run so far, in order.
+func (f *FakeProcessor) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *FakeProcessor) record(op string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, op)
+	return f.Errors[op]
+}
+
+func (f *FakeProcessor) Probe(ctx context.Context, path string) (Probe, error) {
+	if err := f.record("Probe"); err != nil {
+		return Probe{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Probe{}, fmt.Errorf("%w: %v", ErrInvalidMedia, err)
+	}
+	if info.Size() == 0 {
+		return Probe{}, fmt.Errorf("%w: empty file", ErrInvalidMedia)
+	}
+	return f.Result, nil
+}
+
+func (f *FakeProcessor) FastStart(ctx context.Context, src, dst string, progress Progress) error {
+	if err := f.record("FastStart"); err != nil {
+		return err
+	}
+	progress.report(1)
+	return copyFile(src, dst)
+}
+
+func (f *FakeProcessor) Transcode(ctx context.Context, src, dst string, opts TranscodeOptions, progress Progress) error {
+	if err := f.record("Transcode"); err != nil {
+		return err
+	}
+	progress.report(1)
+	return copyFile(src, dst)
+}
+
+// Keyframes reports a keyframe every two seconds of Result.
+func (f *FakeProcessor) Keyframes(ctx context.Context, path string) ([]time.Duration, error) {
+	if err := f.record("Keyframes"); err != nil {
+		return nil, err
+	}
+	keyframes := []time.Duration{}
+	for t := time.Duration(0); t.Seconds() < f.Result.DurationSeconds; t += 2 * time.Second {
+		keyframes = append(keyframes, t)
+	}
+	return keyframes, nil
+}
+
+// ExtractFrame writes a grey 16x9 image. JPEG and PNG are real images; anything
+// else gets placeholder bytes.
+func (f *FakeProcessor) ExtractFrame(ctx context.Context, src, dst string, opts FrameOptions) error {
+	if err := f.record("ExtractFrame"); err != nil {
+		return err
+	}
+	return writeGreyImage(dst, image.Rect(0, 0, 16, 9), "fake frame of "+filepath.Base(src))
+}
+
+// MeasureLoudness reports a fixed, slightly loud measurement.
+func (f *FakeProcessor) MeasureLoudness(ctx context.Context, path string, progress Progress) (Loudness, error) {
+	if err := f.record("MeasureLoudness"); err != nil {
+		return Loudness{}, err
+	}
+	progress.report(1)
+	return Loudness{Integrated: -18.5, TruePeak: -0.8, Range: 6.2, Threshold: -28.7}, nil
+}
+
+func (f *FakeProcessor) AnimatedPreview(ctx context.Context, src, dst string, opts PreviewOptions) error {
+	if err := f.record("AnimatedPreview"); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, []byte("fake preview\n"), 0644)
+}
+
+// SpriteSheets writes as many grey JPEG sheets as Result's duration needs.
+func (f *FakeProcessor) SpriteSheets(ctx context.Context, src, dstPattern string, opts SpriteOptions) error {
+	if err := f.record("SpriteSheets"); err != nil {
+		return err
+	}
+	frames := int(math.Ceil(f.Result.DurationSeconds / opts.Interval.Seconds()))
+	perSheet := opts.Columns * opts.Rows
+	for i := 0; i*perSheet < frames; i++ {
+		bounds := image.Rect(0, 0, opts.Width*opts.Columns, opts.Height*opts.Rows)
+		if err := writeGreyImage(fmt.Sprintf(dstPattern, i), bounds, "fake sprite sheet"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FakeProcessor) PackageHLS(ctx context.Context, renditions []Rendition, outDir string, opts PackageOptions) (string, error) {
+	if err := f.record("PackageHLS"); err != nil {
+		return "", err
+	}
+	return "master.m3u8", f.writePackage(renditions, outDir, "master.m3u8", "playlist.m3u8")
+}
+
+func (f *FakeProcessor) PackageDASH(ctx context.Context, renditions []Rendition, outDir string, opts PackageOptions) (string, error) {
+	if err := f.record("PackageDASH"); err != nil {
+		return "", err
+	}
+	return "manifest.mpd", f.writePackage(renditions, outDir, "manifest.mpd", "")
+}
+
+// writePackage writes a placeholder manifest plus one file per rendition.
+func (f *FakeProcessor) writePackage(renditions []Rendition, outDir, manifest, playlist string) error {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(outDir, manifest), []byte("fake manifest\n"), 0644); err != nil {
+		return err
+	}
+	if playlist == "" {
+		return nil
+	}
+	for _, r := range renditions {
+		dir := filepath.Join(outDir, r.Name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, playlist), []byte("fake playlist\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeGreyImage writes a grey JPEG or PNG, or placeholder text for other extensions.
+func writeGreyImage(dst string, bounds image.Rectangle, placeholder string) error {
+	img := image.NewGray(bounds)
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch filepath.Ext(dst) {
+	case ".jpg", ".jpeg", ".jfif":
+		err = jpeg.Encode(file, img, nil)
+	case ".png":
+		err = png.Encode(file, img)
+	default:
+		_, err = fmt.Fprint(file, placeholder)
+	}
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,266 @@
+package media
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type ownerKey struct{}
+
+// WithOwner tags ctx with who an operation runs for, which Limiter takes turns between.
+func WithOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, ownerKey{}, owner)
+}
+
+func ownerFrom(ctx context.Context) string {
+	owner, _ := ctx.Value(ownerKey{}).(string)
+	return owner
+}
+
+type interactiveKey struct{}
+
+// Interactive marks ctx as work a client is waiting on, like encoding an uploaded
+// image, which Limiter runs in slots of its own rather than behind background jobs.
+func Interactive(ctx context.Context) context.Context {
+	return context.WithValue(ctx, interactiveKey{}, true)
+}
+
+func isInteractive(ctx context.Context) bool {
+	interactive, _ := ctx.Value(interactiveKey{}).(bool)
+	return interactive
+}
+
+// Limiter runs at most a fixed number of operations of the Processor it wraps at
+// once. Operations waiting for a slot are queued per owner (see WithOwner) and the
+// owners take turns, so one owner with many operations can't hold up everyone else.
+// Interactive operations (see Interactive) have separate slots, and probes, which
+// only read headers, aren't limited at all.
+type Limiter struct {
+	processor Processor
+	slots     int
+	// Slots for interactive operations
+	interactive chan struct{}
+
+	mu      sync.Mutex
+	running int
+	// Owners with waiting operations, in the order they get their next turn
+	turns   []string
+	waiting map[string][]chan struct{}
+}
+
+func NewLimiter(processor Processor, slots, interactiveSlots int) *Limiter {
+	return &Limiter{
+		processor:   processor,
+		slots:       max(slots, 1),
+		interactive: make(chan struct{}, max(interactiveSlots, 1)),
+		waiting:     map[string][]chan struct{}{},
+	}
+}
+
+// LimiterStats is a snapshot of a Limiter's queue.
+type LimiterStats struct {
+	Slots   int `json:"slots"`
+	Running int `json:"running"`
+	Waiting int `json:"waiting"`
+	// Number of owners with operations waiting
+	WaitingOwners int `json:"waiting_owners"`
+	// Interactive operations running in their own slots
+	InteractiveRunning int `json:"interactive_running"`
+}
+
+func (l *Limiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := LimiterStats{Slots: l.slots, Running: l.running, WaitingOwners: len(l.turns), InteractiveRunning: len(l.interactive)}
+	for _, queue := range l.waiting {
+		stats.Waiting += len(queue)
+	}
+	return stats
+}
+
+// acquire waits for a slot and returns the func releasing it, which the caller
+// must call once done with it.
+func (l *Limiter) acquire(ctx context.Context) (func(), error) {
+	if isInteractive(ctx) {
+		select {
+		case l.interactive <- struct{}{}:
+			return func() { <-l.interactive }, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err := l.acquireShared(ctx); err != nil {
+		return nil, err
+	}
+	return l.release, nil
+}
+
+// acquireShared waits for one of the slots background operations take turns on.
+func (l *Limiter) acquireShared(ctx context.Context) error {
+	l.mu.Lock()
+	if l.running < l.slots && len(l.turns) == 0 {
+		l.running++
+		l.mu.Unlock()
+		return nil
+	}
+
+	owner := ownerFrom(ctx)
+	ready := make(chan struct{})
+	if len(l.waiting[owner]) == 0 {
+		l.turns = append(l.turns, owner)
+	}
+	l.waiting[owner] = append(l.waiting[owner], ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-ready:
+		// Handed a slot just as ctx ended, pass it on
+		l.releaseLocked()
+	default:
+		l.removeWaiter(owner, ready)
+	}
+	return ctx.Err()
+}
+
+func (l *Limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked()
+}
+
+// releaseLocked hands the slot to the first waiter of the owner whose turn it is.
+func (l *Limiter) releaseLocked() {
+	if len(l.turns) == 0 {
+		l.running--
+		return
+	}
+
+	owner := l.turns[0]
+	l.turns = l.turns[1:]
+	queue := l.waiting[owner]
+	close(queue[0])
+	if len(queue) > 1 {
+		l.waiting[owner] = queue[1:]
+		l.turns = append(l.turns, owner)
+	} else {
+		delete(l.waiting, owner)
+	}
+}
+
+func (l *Limiter) removeWaiter(owner string, ready chan struct{}) {
+	queue := l.waiting[owner]
+	for i, c := range queue {
+		if c == ready {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		l.waiting[owner] = queue
+		return
+	}
+
+	delete(l.waiting, owner)
+	for i, o := range l.turns {
+		if o == owner {
+			l.turns = append(l.turns[:i:i], l.turns[i+1:]...)
+			break
+		}
+	}
+}
+
+// Probe isn't limited, as ffprobe only reads the headers and uploads wait on it.
+func (l *Limiter) Probe(ctx context.Context, path string) (Probe, error) {
+	return l.processor.Probe(ctx, path)
+}
+
+func (l *Limiter) FastStart(ctx context.Context, src, dst string, progress Progress) error {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.processor.FastStart(ctx, src, dst, progress)
+}
+
+func (l *Limiter) Transcode(ctx context.Context, src, dst string, opts TranscodeOptions, progress Progress) error {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.processor.Transcode(ctx, src, dst, opts, progress)
+}
+
+func (l *Limiter) MeasureLoudness(ctx context.Context, path string, progress Progress) (Loudness, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return Loudness{}, err
+	}
+	defer release()
+	return l.processor.MeasureLoudness(ctx, path, progress)
+}
+
+func (l *Limiter) Keyframes(ctx context.Context, path string) ([]time.Duration, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.processor.Keyframes(ctx, path)
+}
+
+func (l *Limiter) ExtractFrame(ctx context.Context, src, dst string, opts FrameOptions) error {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.processor.ExtractFrame(ctx, src, dst, opts)
+}
+
+func (l *Limiter) AnimatedPreview(ctx context.Context, src, dst string, opts PreviewOptions) error {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.processor.AnimatedPreview(ctx, src, dst, opts)
+}
+
+func (l *Limiter) SpriteSheets(ctx context.Context, src, dstPattern string, opts SpriteOptions) error {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.processor.SpriteSheets(ctx, src, dstPattern, opts)
+}
+
+func (l *Limiter) PackageHLS(ctx context.Context, renditions []Rendition, outDir string, opts PackageOptions) (string, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return l.processor.PackageHLS(ctx, renditions, outDir, opts)
+}
+
+func (l *Limiter) PackageDASH(ctx context.Context, renditions []Rendition, outDir string, opts PackageOptions) (string, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return l.processor.PackageDASH(ctx, renditions, outDir, opts)
+}
@@ -0,0 +1,221 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingProcessor holds each Transcode and ExtractFrame of src until src is
+// released, reporting src when one starts.
+type blockingProcessor struct {
+	*FakeProcessor
+	started chan string
+
+	mu       sync.Mutex
+	releases map[string]chan struct{}
+}
+
+func newBlockingProcessor() *blockingProcessor {
+	return &blockingProcessor{
+		FakeProcessor: NewFakeProcessor(),
+		started:       make(chan string, 10),
+		releases:      map[string]chan struct{}{},
+	}
+}
+
+func (p *blockingProcessor) releaseChan(src string) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.releases[src] == nil {
+		p.releases[src] = make(chan struct{})
+	}
+	return p.releases[src]
+}
+
+func (p *blockingProcessor) release(src string) {
+	close(p.releaseChan(src))
+}
+
+func (p *blockingProcessor) block(ctx context.Context, src string) error {
+	p.started <- src
+	select {
+	case <-p.releaseChan(src):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *blockingProcessor) Transcode(ctx context.Context, src, dst string, opts TranscodeOptions, progress Progress) error {
+	return p.block(ctx, src)
+}
+
+func (p *blockingProcessor) ExtractFrame(ctx context.Context, src, dst string, opts FrameOptions) error {
+	return p.block(ctx, src)
+}
+
+// run starts a Transcode of src for owner and returns where its result arrives.
+func run(ctx context.Context, l *Limiter, owner, src string) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Transcode(WithOwner(ctx, owner), src, "", TranscodeOptions{}, Progress{})
+	}()
+	return done
+}
+
+func (p *blockingProcessor) expectStart(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got := <-p.started:
+		if got != want {
+			t.Fatalf("Started %q, want %q", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%q didn't start", want)
+	}
+}
+
+func (p *blockingProcessor) expectNoStart(t *testing.T) {
+	t.Helper()
+	select {
+	case got := <-p.started:
+		t.Fatalf("Started %q while all slots were taken", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// waitForStats polls until the limiter's stats satisfy cond.
+func waitForStats(t *testing.T, l *Limiter, cond func(LimiterStats) bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond(l.Stats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Limiter stats stuck at %+v", l.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimiterTakesTurnsBetweenOwners(t *testing.T) {
+	p := newBlockingProcessor()
+	l := NewLimiter(p, 1, 1)
+	ctx := context.Background()
+
+	run(ctx, l, "alice", "alice-0")
+	p.expectStart(t, "alice-0")
+
+	// alice queues up two more before bob asks for one
+	for i, op := range []struct{ owner, src string }{
+		{"alice", "alice-1"},
+		{"alice", "alice-2"},
+		{"bob", "bob-0"},
+	} {
+		run(ctx, l, op.owner, op.src)
+		waitForStats(t, l, func(s LimiterStats) bool { return s.Waiting == i+1 })
+	}
+	p.expectNoStart(t)
+
+	running := "alice-0"
+	for _, want := range []string{"alice-1", "bob-0", "alice-2"} {
+		p.release(running)
+		p.expectStart(t, want)
+		running = want
+	}
+	p.release(running)
+	waitForStats(t, l, func(s LimiterStats) bool { return s.Running == 0 && s.Waiting == 0 && s.WaitingOwners == 0 })
+}
+
+func TestLimiterCancelWhileWaiting(t *testing.T) {
+	p := newBlockingProcessor()
+	l := NewLimiter(p, 1, 1)
+	ctx := context.Background()
+
+	first := run(ctx, l, "alice", "alice-0")
+	p.expectStart(t, "alice-0")
+
+	waitCtx, cancel := context.WithCancel(ctx)
+	cancelled := run(waitCtx, l, "bob", "bob-0")
+	waitForStats(t, l, func(s LimiterStats) bool { return s.Waiting == 1 })
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Cancelled operation returned %v, want context.Canceled", err)
+	}
+	if stats := l.Stats(); stats.Waiting != 0 || stats.WaitingOwners != 0 || stats.Running != 1 {
+		t.Errorf("Stats after cancelling = %+v, want only the running operation", stats)
+	}
+
+	p.release("alice-0")
+	if err := <-first; err != nil {
+		t.Fatalf("First operation: %v", err)
+	}
+	p.expectNoStart(t)
+
+	// The slot came back rather than going to the cancelled waiter
+	run(ctx, l, "carol", "carol-0")
+	p.expectStart(t, "carol-0")
+	p.release("carol-0")
+	waitForStats(t, l, func(s LimiterStats) bool { return s.Running == 0 })
+}
+
+func TestLimiterInteractiveSlots(t *testing.T) {
+	p := newBlockingProcessor()
+	l := NewLimiter(p, 1, 1)
+	ctx := context.Background()
+
+	run(ctx, l, "alice", "background")
+	p.expectStart(t, "background")
+
+	// Doesn't wait behind the background operation
+	interactive := make(chan error, 1)
+	go func() {
+		interactive <- l.ExtractFrame(Interactive(ctx), "interactive-0", "", FrameOptions{})
+	}()
+	p.expectStart(t, "interactive-0")
+	if stats := l.Stats(); stats.InteractiveRunning != 1 || stats.Running != 1 {
+		t.Errorf("Stats = %+v, want one background and one interactive operation", stats)
+	}
+
+	// Probes aren't limited at all
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(path, []byte("video"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	probed := make(chan error, 1)
+	go func() {
+		_, err := l.Probe(ctx, path)
+		probed <- err
+	}()
+	select {
+	case err := <-probed:
+		if err != nil {
+			t.Errorf("Probe: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Probe waited for a slot")
+	}
+
+	// The interactive slot is taken, so the next interactive operation waits
+	waitCtx, cancel := context.WithCancel(ctx)
+	waiting := make(chan error, 1)
+	go func() {
+		waiting <- l.ExtractFrame(Interactive(waitCtx), "interactive-1", "", FrameOptions{})
+	}()
+	p.expectNoStart(t)
+	cancel()
+	if err := <-waiting; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Cancelled interactive operation returned %v, want context.Canceled", err)
+	}
+
+	p.release("interactive-0")
+	if err := <-interactive; err != nil {
+		t.Fatalf("Interactive operation: %v", err)
+	}
+	waitForStats(t, l, func(s LimiterStats) bool { return s.InteractiveRunning == 0 })
+	p.release("background")
+	waitForStats(t, l, func(s LimiterStats) bool { return s.Running == 0 })
+}
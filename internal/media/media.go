@@ -0,0 +1,199 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+// ErrInvalidMedia means the input itself couldn't be read, as opposed to the
+// tools failing to run.
+var ErrInvalidMedia = errors.New("invalid media")
+
+// ErrNoFrame means ExtractFrame found no frame matching its options.
+var ErrNoFrame = errors.New("no frame extracted")
+
+// Processor is the media toolchain video processing runs on. Paths are local files.
+type Processor interface {
+	// Probe describes the first video and audio streams of a file and its container.
+	Probe(ctx context.Context, path string) (Probe, error)
+	// FastStart rewrites an MP4 with its index at the front, without re-encoding,
+	// so playback can start before the whole file has downloaded.
+	FastStart(ctx context.Context, src, dst string, progress Progress) error
+	// Transcode converts the first video and audio streams of src into an MP4 at dst,
+	// or an MP3 when dst ends in ".mp3".
+	Transcode(ctx context.Context, src, dst string, opts TranscodeOptions, progress Progress) error
+	// MeasureLoudness measures the EBU R128 loudness of the first audio stream of path.
+	MeasureLoudness(ctx context.Context, path string, progress Progress) (Loudness, error)
+	// Keyframes lists the timestamps of the keyframes of the first video stream, in order.
+	Keyframes(ctx context.Context, path string) ([]time.Duration, error)
+	// ExtractFrame writes a single frame of src as an image, in the format dst's
+	// extension names. Still images work as src as well, to convert them.
+	ExtractFrame(ctx context.Context, src, dst string, opts FrameOptions) error
+	// AnimatedPreview writes a short silent clip of src as an animated image, in the
+	// format dst's extension names (".webp" or ".gif").
+	AnimatedPreview(ctx context.Context, src, dst string, opts PreviewOptions) error
+	// SpriteSheets writes a frame every opts.Interval, tiled into JPEG sheets named
+	// after the dstPattern printf pattern and numbered from 0, e.g. "sprite-%d.jpg".
+	SpriteSheets(ctx context.Context, src, dstPattern string, opts SpriteOptions) error
+	// PackageHLS segments MP4 renditions into outDir without re-encoding them and
+	// returns the master playlist's path relative to outDir.
+	PackageHLS(ctx context.Context, renditions []Rendition, outDir string, opts PackageOptions) (string, error)
+	// PackageDASH is PackageHLS for an MPEG-DASH manifest with fMP4 segments.
+	PackageDASH(ctx context.Context, renditions []Rendition, outDir string, opts PackageOptions) (string, error)
+}
+
+// Probe is what a Processor found out about a file.
+type Probe struct {
+	// Coded frame size, before Rotation and SampleAspectRatio are applied
+	Width  int
+	Height int
+	// Clockwise degrees players rotate the picture by, a multiple of 90
+	Rotation int
+	// Shape of a single pixel, 1 for the square pixels almost everything uses
+	SampleAspectRatio float64
+	DurationSeconds   float64
+	VideoCodec        string
+	HasAudio          bool
+	AudioCodec        string
+	AudioChannels     int
+	BitRate           int64
+	FrameRate         float64
+	// ffprobe's demuxer names, e.g. "mov,mp4,m4a,3gp,3g2,mj2" or "matroska,webm"
+	FormatName string
+}
+
+// DisplaySize is the size the video is shown at, which is what its shape and
+// resolution should go by.
+func (p Probe) DisplaySize() (int, int) {
+	width, height := p.Width, p.Height
+	if p.SampleAspectRatio > 0 && p.SampleAspectRatio != 1 {
+		width = int(math.Round(float64(width) * p.SampleAspectRatio))
+	}
+	if p.Rotation%180 != 0 {
+		width, height = height, width
+	}
+	return width, height
+}
+
+// Progress reports how far an operation has got through an input DurationSeconds
+// long. The zero value reports nothing.
+type Progress struct {
+	DurationSeconds float64
+	Report          func(fraction float64)
+}
+
+func (p Progress) report(fraction float64) {
+	if p.Report != nil {
+		p.Report(min(max(fraction, 0), 1))
+	}
+}
+
+// Loudness is what MeasureLoudness found. Silence measures as -Inf.
+type Loudness struct {
+	// Integrated loudness over the whole stream, in LUFS
+	Integrated float64
+	// In dBTP
+	TruePeak float64
+	// Loudness range, in LU
+	Range float64
+	// Gating threshold, in LUFS
+	Threshold float64
+}
+
+// TranscodeOptions describe the output of Transcode. Rotation is applied whenever
+// the video is re-encoded.
+type TranscodeOptions struct {
+	// "copy" keeps the video stream as it is, "libx264" re-encodes it to H.264.
+	// Video is dropped unless set.
+	VideoCodec string
+	Preset     string
+	Profile    string
+	// Constant quality mode, used when VideoBitrate is empty
+	CRF          int
+	VideoBitrate string
+	MaxRate      string
+	BufSize      string
+	// Fixed keyframe interval in frames, 0 lets the encoder decide
+	GOP         int
+	PixelFormat string
+	// ffmpeg video filter graph, e.g. "scale=-2:720"
+	VideoFilter string
+	// Overlaid after VideoFilter, which needs the video re-encoded
+	Watermark *Watermark
+
+	// Audio is dropped unless set
+	AudioCodec    string
+	AudioBitrate  string
+	AudioChannels int
+	// ffmpeg audio filter graph, e.g. "loudnorm=I=-23"
+	AudioFilter string
+
+	// Move the index to the front, as FastStart does
+	FastStart bool
+
+	// Cut the output to start at Start and end at End, or at the end of src when
+	// End is 0. Stream copies can only start cleanly at a keyframe.
+	Start time.Duration
+	End   time.Duration
+}
+
+// WatermarkPositions are the corners and the middle of the picture, where a
+// Watermark can be placed.
+var WatermarkPositions = []string{"top-left", "top-right", "bottom-left", "bottom-right", "center"}
+
+// Watermark is an image, typically a logo with a transparent background, overlaid
+// on a video.
+type Watermark struct {
+	ImagePath string
+	// One of WatermarkPositions
+	Position string
+	// 0 (invisible) to 1 (as opaque as the image)
+	Opacity float64
+	// Width of the image as a fraction of the video's width
+	Scale float64
+}
+
+// FrameOptions choose the frame ExtractFrame writes.
+type FrameOptions struct {
+	// Where to start looking for the frame
+	Offset time.Duration
+	// ffmpeg video filter graph picking or preparing the frame
+	VideoFilter string
+	// Encoder quality; lower is better for JPEG (2-31), higher for WebP (0-100).
+	// 0 uses the encoder's default.
+	Quality int
+}
+
+// PreviewOptions choose the part of the video AnimatedPreview shows and its size.
+type PreviewOptions struct {
+	Start    time.Duration
+	Duration time.Duration
+	Width    int
+	FPS      int
+}
+
+// SpriteOptions lay out the frames of SpriteSheets.
+type SpriteOptions struct {
+	Interval time.Duration
+	// Size of each frame
+	Width  int
+	Height int
+	// Frames per sheet, across and down
+	Columns int
+	Rows    int
+}
+
+// Rendition is one encoded rung of an adaptive bitrate ladder.
+type Rendition struct {
+	// Used in the names of the rendition's playlist and segments
+	Name string
+	Path string
+}
+
+type PackageOptions struct {
+	// Whether the renditions carry audio, which is taken from the first one for DASH
+	HasAudio       bool
+	SegmentSeconds int
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type LocalStore struct {
+	root    string
+	baseURL string
+}
+
+// NewLocalStore returns a store that keeps objects as files under root,
+// with object URLs served from baseURL.
+func NewLocalStore(root, baseURL string) *LocalStore {
+	return &LocalStore{
+		root:    root,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	diskPath, err := s.diskPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(diskPath), 0755); err != nil {
+		return fmt.Errorf("error creating directory for %s: %w", key, err)
+	}
+
+	// Write to a temp file first so readers never observe a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(diskPath), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating file for %s: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		return fmt.Errorf("error writing %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), diskPath); err != nil {
+		return fmt.Errorf("error writing %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	diskPath, err := s.diskPath(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return nil, localError(key, err)
+	}
+	return f, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	diskPath, err := s.diskPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(diskPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error deleting %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *LocalStore) Copy(ctx context.Context, srcKey, dstKey string) error {
+	src, err := s.Get(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return s.Put(ctx, dstKey, src, "")
+}
+
+func (s *LocalStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	diskPath, err := s.diskPath(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(diskPath)
+	if err != nil {
+		return ObjectInfo{}, localError(key, err)
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return s.objectInfo(key, info), nil
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, s.objectInfo(key, info))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects under %q: %w", prefix, err)
+	}
+	return objects, nil
+}
+
+func (s *LocalStore) URL(key string) string {
+	return fmt.Sprintf("%s/%s", s.baseURL, key)
+}
+
+func (s *LocalStore) diskPath(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if key == "" || cleaned == "/" || cleaned[1:] != key {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalStore) objectInfo(key string, info fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		ContentType:  mime.TypeByExtension(path.Ext(key)),
+		LastModified: info.ModTime(),
+	}
+}
+
+func localError(key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return fmt.Errorf("error accessing %s: %w", key, err)
+}
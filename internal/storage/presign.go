@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Presigner is implemented by stores that can let clients upload directly to them,
+// without the bytes passing through this server.
+type Presigner interface {
+	PresignPut(ctx context.Context, key, contentType string, expires time.Duration) (PresignedRequest, error)
+}
+
+type PresignedRequest struct {
+	URL    string      `json:"url"`
+	Method string      `json:"method"`
+	Header http.Header `json:"headers"`
+	// Expiry of the signature, not of the object
+	ExpiresAt time.Time `json:"expires_at"`
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type S3Store struct {
+	client  *s3.Client
+	bucket  string
+	baseURL string
+	opts    S3Options
+}
+
+// NewS3Store returns a store backed by bucket, with object URLs served from baseURL
+// (usually a CloudFront distribution).
+func NewS3Store(client *s3.Client, bucket, baseURL string, opts S3Options) *S3Store {
+	return &S3Store{
+		client:  client,
+		bucket:  bucket,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		opts:    opts.normalized(),
+	}
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(key, err)
+	}
+	return out.Body, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting object %s: %w", key, err)
+	}
+	return nil
+}
+
+// Copy copies within the bucket with a single CopyObject request, which takes
+// objects of up to 5 GB.
+func (s *S3Store) Copy(ctx context.Context, srcKey, dstKey string) error {
+	// The source is URL-encoded, apart from the slashes between key segments
+	source := s.bucket + "/" + strings.ReplaceAll(url.PathEscape(srcKey), "%2F", "/")
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(source),
+	})
+	if err != nil {
+		return s3Error(srcKey, err)
+	}
+	return nil
+}
+
+func (s *S3Store) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, s3Error(key, err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error listing objects under %q: %w", prefix, err)
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func (s *S3Store) URL(key string) string {
+	return fmt.Sprintf("%s/%s", s.baseURL, key)
+}
+
+func s3Error(key string, err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return fmt.Errorf("error accessing object %s: %w", key, err)
+}
+
+func (s *S3Store) PresignPut(ctx context.Context, key, contentType string, expires time.Duration) (PresignedRequest, error) {
+	presignClient := s3.NewPresignClient(s.client)
+	req, err := presignClient.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return PresignedRequest{}, fmt.Errorf("error presigning upload for %s: %w", key, err)
+	}
+	// Browsers set Host themselves and refuse to let scripts override it
+	header := req.SignedHeader.Clone()
+	header.Del("Host")
+
+	return PresignedRequest{
+		URL:       req.URL,
+		Method:    req.Method,
+		Header:    header,
+		ExpiresAt: time.Now().UTC().Add(expires),
+	}, nil
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// S3 rejects parts smaller than 5 MiB (except the last one) and uploads with more than 10,000 parts
+	minPartSize  = 5 << 20
+	maxPartCount = 10000
+)
+
+type S3Options struct {
+	// Objects at least this large are sent with the multipart upload API
+	MultipartThreshold int64
+	PartSize           int64
+	// Number of parts uploaded in parallel
+	Concurrency int
+	// Number of times a single part is retried before the upload is aborted
+	MaxPartRetries int
+}
+
+func DefaultS3Options() S3Options {
+	return S3Options{
+		MultipartThreshold: 100 << 20,
+		PartSize:           16 << 20,
+		Concurrency:        4,
+		MaxPartRetries:     3,
+	}
+}
+
+func (o S3Options) normalized() S3Options {
+	defaults := DefaultS3Options()
+	if o.MultipartThreshold <= 0 {
+		o.MultipartThreshold = defaults.MultipartThreshold
+	}
+	if o.PartSize < minPartSize {
+		o.PartSize = minPartSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = defaults.Concurrency
+	}
+	if o.MaxPartRetries < 0 {
+		o.MaxPartRetries = 0
+	}
+	return o
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	size, ok := readerSize(body)
+	if ok {
+		if size < s.opts.MultipartThreshold {
+			return s.putObject(ctx, key, body, contentType)
+		}
+		return s.putMultipart(ctx, key, body, size, contentType)
+	}
+
+	// Without a known size, only a body longer than one part is worth splitting up
+	first := make([]byte, s.opts.PartSize)
+	n, err := io.ReadFull(body, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.putObject(ctx, key, bytes.NewReader(first[:n]), contentType)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading body for %s: %w", key, err)
+	}
+	return s.putMultipart(ctx, key, io.MultiReader(bytes.NewReader(first), body), -1, contentType)
+}
+
+func (s *S3Store) putObject(ctx context.Context, key string, body io.Reader, contentType string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("error putting object %s: %w", key, err)
+	}
+	return nil
+}
+
+// putMultipart uploads body in parts, several at a time. The upload is aborted if any
+// part fails for good or ctx is cancelled, so no half-finished upload is left billing storage.
+func (s *S3Store) putMultipart(ctx context.Context, key string, body io.Reader, size int64, contentType string) (err error) {
+	partSize := s.opts.PartSize
+	if size > 0 && size/partSize >= maxPartCount {
+		partSize = size/maxPartCount + 1
+	}
+
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating multipart upload for %s: %w", key, err)
+	}
+	uploadID := created.UploadId
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		// The request context may already be cancelled, but the abort still has to go through
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		_, abortErr := s.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: uploadID,
+		})
+		if abortErr != nil {
+			err = errors.Join(err, fmt.Errorf("error aborting multipart upload for %s: %w", key, abortErr))
+		}
+	}()
+
+	partsCtx, cancelParts := context.WithCancel(ctx)
+	defer cancelParts()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []types.CompletedPart
+		partsErr error
+	)
+	sem := make(chan struct{}, s.opts.Concurrency)
+
+	var readErr error
+	for partNumber := int32(1); ; partNumber++ {
+		if partNumber > maxPartCount {
+			readErr = fmt.Errorf("object %s needs more than %d parts", key, maxPartCount)
+			break
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-partsCtx.Done():
+		}
+		if partsCtx.Err() != nil {
+			break
+		}
+
+		buf := make([]byte, partSize)
+		n, err := io.ReadFull(body, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			<-sem
+			readErr = fmt.Errorf("error reading body for %s: %w", key, err)
+			break
+		}
+		if n == 0 {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(partNumber int32, data []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			etag, err := s.uploadPart(partsCtx, key, uploadID, partNumber, data)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if partsErr == nil {
+					partsErr = err
+					cancelParts()
+				}
+				return
+			}
+			parts = append(parts, types.CompletedPart{
+				ETag:       etag,
+				PartNumber: aws.Int32(partNumber),
+			})
+		}(partNumber, buf[:n])
+
+		if n < len(buf) {
+			break
+		}
+	}
+	wg.Wait()
+
+	if partsErr != nil {
+		return partsErr
+	}
+	if readErr != nil {
+		return readErr
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("multipart upload for %s cancelled: %w", key, err)
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber)
+	})
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return fmt.Errorf("error completing multipart upload for %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *S3Store) uploadPart(ctx context.Context, key string, uploadID *string, partNumber int32, data []byte) (*string, error) {
+	backoff := 500 * time.Millisecond
+	var lastErr error
+	for attempt := 0; attempt <= s.opts.MaxPartRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(key),
+			UploadId:   uploadID,
+			PartNumber: aws.Int32(partNumber),
+			Body:       bytes.NewReader(data),
+		})
+		if err == nil {
+			return out.ETag, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("error uploading part %d of %s after %d attempts: %w",
+		partNumber, key, s.opts.MaxPartRetries+1, lastErr)
+}
+
+// readerSize reports how many bytes are left in body, if that can be known up front.
+func readerSize(body io.Reader) (int64, bool) {
+	switch r := body.(type) {
+	case *os.File:
+		info, err := r.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0, false
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		return info.Size() - offset, true
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+	}
+	return 0, false
+}
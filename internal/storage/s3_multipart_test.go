@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3Stub answers the multipart upload API for a single bucket, keeping the parts in memory.
+type s3Stub struct {
+	mu sync.Mutex
+	// How many more times an upload of each part fails
+	failures map[int32]int
+	// If set, parts never finish; each one is announced on partStarted instead
+	hang        bool
+	partStarted chan struct{}
+
+	attempts  map[int32]int
+	parts     map[int32][]byte
+	completed []byte
+	aborted   bool
+}
+
+func newS3Stub() *s3Stub {
+	return &s3Stub{
+		failures:    map[int32]int{},
+		partStarted: make(chan struct{}, maxPartCount),
+		attempts:    map[int32]int{},
+		parts:       map[int32][]byte{},
+	}
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>tubely</Bucket><Key>video.mp4</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		n, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		partNumber := int32(n)
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		if s.hang {
+			s.partStarted <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.attempts[partNumber]++
+		if s.failures[partNumber] > 0 {
+			s.failures[partNumber]--
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<Error><Code>InternalError</Code><Message>part failed</Message></Error>`)
+			return
+		}
+		s.parts[partNumber] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, partNumber))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		var upload struct {
+			Parts []struct {
+				ETag       string
+				PartNumber int32
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&upload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var object []byte
+		for i, part := range upload.Parts {
+			if part.PartNumber != int32(i+1) || part.ETag != fmt.Sprintf(`"part-%d"`, part.PartNumber) {
+				http.Error(w, fmt.Sprintf("unexpected part %+v at %d", part, i), http.StatusBadRequest)
+				return
+			}
+			object = append(object, s.parts[part.PartNumber]...)
+		}
+		s.completed = object
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>tubely</Bucket><Key>video.mp4</Key><ETag>"object"</ETag></CompleteMultipartUploadResult>`)
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+	}
+}
+
+// newStubbedS3Store returns a store that sends every object as a multipart upload to stub.
+func newStubbedS3Store(t *testing.T, stub *s3Stub, opts S3Options) *S3Store {
+	t.Helper()
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+		// Retrying a part is putMultipart's job here, not the SDK's
+		Retryer: aws.NopRetryer{},
+	})
+	opts.MultipartThreshold = 1
+	opts.PartSize = minPartSize
+	return NewS3Store(client, "tubely", "https://cdn.example.com", opts)
+}
+
+func TestS3PutMultipartSplitsAndRetriesParts(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), (2*minPartSize+1<<20)/16)
+
+	tests := []struct {
+		name string
+		body io.Reader
+	}{
+		{"known size", bytes.NewReader(body)},
+		{"unknown size", io.MultiReader(bytes.NewReader(body))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newS3Stub()
+			stub.failures[2] = 1
+			store := newStubbedS3Store(t, stub, S3Options{Concurrency: 2, MaxPartRetries: 3})
+
+			if err := store.Put(context.Background(), "video.mp4", tt.body, "video/mp4"); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			if len(stub.parts) != 3 || len(stub.parts[1]) != minPartSize || len(stub.parts[2]) != minPartSize || len(stub.parts[3]) != 1<<20 {
+				t.Errorf("Got %d parts, want two of %d bytes and one of %d", len(stub.parts), minPartSize, 1<<20)
+			}
+			if stub.attempts[2] != 2 {
+				t.Errorf("Part 2 was sent %d times, want 2", stub.attempts[2])
+			}
+			if !bytes.Equal(stub.completed, body) {
+				t.Errorf("Completed object is %d bytes and doesn't match the %d byte body", len(stub.completed), len(body))
+			}
+			if stub.aborted {
+				t.Error("Upload was aborted")
+			}
+		})
+	}
+}
+
+func TestS3PutMultipartAbortsWhenPartFails(t *testing.T) {
+	stub := newS3Stub()
+	stub.failures[2] = 100
+	store := newStubbedS3Store(t, stub, S3Options{Concurrency: 2, MaxPartRetries: 1})
+
+	body := bytes.Repeat([]byte{'x'}, 2*minPartSize)
+	if err := store.Put(context.Background(), "video.mp4", bytes.NewReader(body), "video/mp4"); err == nil {
+		t.Fatal("Put succeeded although part 2 always fails")
+	}
+	if stub.attempts[2] != 2 {
+		t.Errorf("Part 2 was sent %d times, want 2", stub.attempts[2])
+	}
+	if !stub.aborted {
+		t.Error("Upload wasn't aborted")
+	}
+	if stub.completed != nil {
+		t.Error("Upload was completed")
+	}
+}
+
+func TestS3PutMultipartAbortsWhenCancelled(t *testing.T) {
+	stub := newS3Stub()
+	stub.hang = true
+	store := newStubbedS3Store(t, stub, S3Options{Concurrency: 2})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stub.partStarted
+		cancel()
+	}()
+
+	body := bytes.Repeat([]byte{'x'}, 3*minPartSize)
+	err := store.Put(ctx, "video.mp4", bytes.NewReader(body), "video/mp4")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Put returned %v, want context.Canceled", err)
+	}
+	if !stub.aborted {
+		t.Error("Upload wasn't aborted")
+	}
+	if stub.completed != nil {
+		t.Error("Upload was completed")
+	}
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// ObjectStore is the common abstraction over wherever uploaded bytes live.
+// Keys are slash separated and never start with a slash.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, body io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// Copy copies the object at srcKey to dstKey within the store, without the
+	// bytes passing through the caller where the backend allows.
+	Copy(ctx context.Context, srcKey, dstKey string) error
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	URL(key string) string
+}
+
+// KeyFromURL reverses store.URL, reporting false if rawURL wasn't produced by the store.
+func KeyFromURL(store ObjectStore, rawURL string) (string, bool) {
+	base := store.URL("")
+	if !strings.HasPrefix(rawURL, base) {
+		return "", false
+	}
+	key := strings.TrimPrefix(rawURL, base)
+	if key == "" {
+		return "", false
+	}
+	return key, true
+}
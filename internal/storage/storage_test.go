@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// stores returns a fresh instance of every backend that runs without AWS.
+func stores(t *testing.T) map[string]ObjectStore {
+	t.Helper()
+	return map[string]ObjectStore{
+		"local":  NewLocalStore(t.TempDir(), "http://localhost:8091/assets/"),
+		"memory": NewMemoryStore("http://localhost:8091/assets/"),
+	}
+}
+
+func put(t *testing.T, store ObjectStore, key, body string) {
+	t.Helper()
+	if err := store.Put(context.Background(), key, strings.NewReader(body), "image/png"); err != nil {
+		t.Fatalf("Put(%q): %v", key, err)
+	}
+}
+
+func TestPutGetHead(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		body string
+	}{
+		{"top level", "a.png", "first"},
+		{"nested", "videos/abc/thumb.png", "second"},
+		{"empty", "empty.png", ""},
+	}
+
+	for storeName, store := range stores(t) {
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				put(t, store, tt.key, tt.body)
+
+				rc, err := store.Get(ctx, tt.key)
+				if err != nil {
+					t.Fatalf("Get: %v", err)
+				}
+				got, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatalf("reading object: %v", err)
+				}
+				if string(got) != tt.body {
+					t.Errorf("Get = %q, want %q", got, tt.body)
+				}
+
+				info, err := store.Head(ctx, tt.key)
+				if err != nil {
+					t.Fatalf("Head: %v", err)
+				}
+				if info.Key != tt.key || info.Size != int64(len(tt.body)) || info.ContentType != "image/png" {
+					t.Errorf("Head = %+v, want key %q, size %d, image/png", info, tt.key, len(tt.body))
+				}
+			})
+		}
+	}
+}
+
+func TestPutOverwrites(t *testing.T) {
+	for storeName, store := range stores(t) {
+		t.Run(storeName, func(t *testing.T) {
+			put(t, store, "a.png", "old")
+			put(t, store, "a.png", "newer")
+
+			info, err := store.Head(context.Background(), "a.png")
+			if err != nil {
+				t.Fatalf("Head: %v", err)
+			}
+			if info.Size != int64(len("newer")) {
+				t.Errorf("Size = %d, want %d", info.Size, len("newer"))
+			}
+		})
+	}
+}
+
+func TestMissingObjects(t *testing.T) {
+	for storeName, store := range stores(t) {
+		t.Run(storeName, func(t *testing.T) {
+			ctx := context.Background()
+			if _, err := store.Get(ctx, "missing.png"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get error = %v, want ErrNotFound", err)
+			}
+			if _, err := store.Head(ctx, "missing.png"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Head error = %v, want ErrNotFound", err)
+			}
+			if err := store.Delete(ctx, "missing.png"); err != nil {
+				t.Errorf("Delete of a missing object = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	for storeName, store := range stores(t) {
+		t.Run(storeName, func(t *testing.T) {
+			ctx := context.Background()
+			put(t, store, "a.png", "data")
+			put(t, store, "b.png", "data")
+
+			if err := store.Delete(ctx, "a.png"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := store.Head(ctx, "a.png"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Head after Delete = %v, want ErrNotFound", err)
+			}
+			if _, err := store.Head(ctx, "b.png"); err != nil {
+				t.Errorf("Delete removed another object: %v", err)
+			}
+		})
+	}
+}
+
+func TestCopy(t *testing.T) {
+	for storeName, store := range stores(t) {
+		t.Run(storeName, func(t *testing.T) {
+			ctx := context.Background()
+			put(t, store, "incoming/a.png", "data")
+
+			if err := store.Copy(ctx, "incoming/a.png", "originals/1/a.png"); err != nil {
+				t.Fatalf("Copy: %v", err)
+			}
+			rc, err := store.Get(ctx, "originals/1/a.png")
+			if err != nil {
+				t.Fatalf("Get copy: %v", err)
+			}
+			got, _ := io.ReadAll(rc)
+			rc.Close()
+			if string(got) != "data" {
+				t.Errorf("Copy has %q, want %q", got, "data")
+			}
+			if info, err := store.Head(ctx, "originals/1/a.png"); err != nil || info.ContentType != "image/png" {
+				t.Errorf("Head copy = %+v (%v), want image/png", info, err)
+			}
+
+			// The source is left as it was
+			put(t, store, "incoming/a.png", "changed")
+			if info, err := store.Head(ctx, "originals/1/a.png"); err != nil || info.Size != int64(len("data")) {
+				t.Errorf("Head copy after changing the source = %+v (%v)", info, err)
+			}
+
+			if err := store.Copy(ctx, "missing.png", "b.png"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Copy of a missing object = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	keys := []string{"a.png", "videos/1/a.png", "videos/1/b.png", "videos/2/a.png", "videos10.png"}
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", keys},
+		{"videos/", []string{"videos/1/a.png", "videos/1/b.png", "videos/2/a.png"}},
+		{"videos/1/", []string{"videos/1/a.png", "videos/1/b.png"}},
+		// Prefixes are plain string prefixes, like S3, not directories
+		{"videos1", []string{"videos10.png"}},
+		{"missing/", nil},
+	}
+
+	for storeName, store := range stores(t) {
+		for _, key := range keys {
+			put(t, store, key, "data")
+		}
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.prefix, func(t *testing.T) {
+				objects, err := store.List(context.Background(), tt.prefix)
+				if err != nil {
+					t.Fatalf("List: %v", err)
+				}
+				var got []string
+				for _, obj := range objects {
+					got = append(got, obj.Key)
+				}
+				if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+					t.Errorf("List(%q) = %v, want %v", tt.prefix, got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestLocalStoreRejectsInvalidKeys(t *testing.T) {
+	store := NewLocalStore(t.TempDir(), "http://localhost:8091/assets")
+	for _, key := range []string{"", "/a.png", "../a.png", "a/../../b.png", "a//b.png"} {
+		if err := store.Put(context.Background(), key, strings.NewReader("data"), "image/png"); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+	}
+}
+
+func TestKeyFromURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		rawURL string
+		want   string
+		wantOK bool
+	}{
+		{"own object", "http://localhost:8091/assets/a.png", "a.png", true},
+		{"nested object", "http://localhost:8091/assets/videos/1/a.png", "videos/1/a.png", true},
+		{"store root", "http://localhost:8091/assets/", "", false},
+		{"other host", "https://cdn.example.com/assets/a.png", "", false},
+		{"other path", "http://localhost:8091/other/a.png", "", false},
+	}
+
+	for storeName, store := range stores(t) {
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.name, func(t *testing.T) {
+				key, ok := KeyFromURL(store, tt.rawURL)
+				if key != tt.want || ok != tt.wantOK {
+					t.Errorf("KeyFromURL(%q) = %q, %v, want %q, %v", tt.rawURL, key, ok, tt.want, tt.wantOK)
+				}
+			})
+		}
+		t.Run(storeName+"/round trip", func(t *testing.T) {
+			if key, ok := KeyFromURL(store, store.URL("videos/a.png")); !ok || key != "videos/a.png" {
+				t.Errorf("KeyFromURL(URL(key)) = %q, %v, want the key back", key, ok)
+			}
+		})
+	}
+}
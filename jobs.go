@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobPollInterval = 2 * time.Second
+	// Also how long a job cancelled on another server instance keeps running
+	jobHeartbeatInterval = 10 * time.Second
+	// A running job whose lock hasn't been refreshed for this long was abandoned
+	jobLockTimeout  = 5 * time.Minute
+	jobMaxBackoff   = 30 * time.Minute
+	jobMaxAttempts  = 5
+	jobInitialDelay = 30 * time.Second
+)
+
+type jobHandler func(ctx context.Context, job database.Job) error
+
+// permanentError marks a job failure that retrying can't fix, like an unsupported file.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+var errJobCancelled = errors.New("processing was cancelled")
+
+// runningJobs lets jobs running in this process be cancelled right away rather
+// than on their next heartbeat.
+type runningJobs struct {
+	mu      sync.Mutex
+	byVideo map[uuid.UUID]context.CancelCauseFunc
+}
+
+func newRunningJobs() *runningJobs {
+	return &runningJobs{byVideo: map[uuid.UUID]context.CancelCauseFunc{}}
+}
+
+// add registers the job running for videoID and returns a func removing it again.
+func (r *runningJobs) add(videoID uuid.UUID, cancel context.CancelCauseFunc) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byVideo[videoID] = cancel
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.byVideo, videoID)
+	}
+}
+
+// cancel stops the job running for videoID, reporting whether there was one.
+func (r *runningJobs) cancel(videoID uuid.UUID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cancel, ok := r.byVideo[videoID]
+	if ok {
+		cancel(errJobCancelled)
+	}
+	return ok
+}
+
+func (cfg *apiConfig) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		jobKindProcessVideo: cfg.handleProcessVideoJob,
+		jobKindTrimVideo:    cfg.handleTrimVideoJob,
+	}
+}
+
+// startJobWorkers runs n workers that process queued jobs until ctx is done.
+func (cfg *apiConfig) startJobWorkers(ctx context.Context, n int) {
+	handlers := cfg.jobHandlers()
+	for i := 0; i < n; i++ {
+		go cfg.runJobWorker(ctx, handlers)
+	}
+	go cfg.requeueStaleJobs(ctx)
+	go cfg.expireVideoUploads(ctx)
+}
+
+func (cfg *apiConfig) runJobWorker(ctx context.Context, handlers map[string]jobHandler) {
+	for {
+		job, err := cfg.db.ClaimJob()
+		if err != nil {
+			log.Printf("Couldn't claim job: %v", err)
+		}
+		if job != nil {
+			cfg.runJob(ctx, handlers, *job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+func (cfg *apiConfig) runJob(ctx context.Context, handlers map[string]jobHandler, job database.Job) {
+	handler, ok := handlers[job.Kind]
+	if !ok {
+		cfg.failJob(job, permanent(fmt.Errorf("unknown job kind %q", job.Kind)))
+		return
+	}
+
+	// Only once the video's status reflects how the job went
+	defer cfg.progress.publish(progressEvent{VideoID: job.VideoID, Done: true})
+
+	// Cancelled while it was waiting to be retried
+	if job.CancelRequestedAt != nil {
+		cfg.cancelJob(job)
+		return
+	}
+
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer cfg.runningJobs.add(job.VideoID, cancel)()
+
+	heartbeatCtx, stopHeartbeat := context.WithCancel(jobCtx)
+	go cfg.heartbeatJob(heartbeatCtx, job, cancel)
+	err := handler(jobCtx, job)
+	stopHeartbeat()
+
+	// A job that got to the end anyway has done no harm
+	if err != nil && errors.Is(context.Cause(jobCtx), errJobCancelled) {
+		cfg.cancelJob(job)
+		return
+	}
+	if err != nil {
+		cfg.failJob(job, err)
+		return
+	}
+	if err := cfg.db.CompleteJob(job.ID); err != nil {
+		log.Printf("Couldn't mark job %s complete: %v", job.ID, err)
+	}
+}
+
+// cancelJob records that a job was cancelled and takes its video out of processing.
+func (cfg *apiConfig) cancelJob(job database.Job) {
+	log.Printf("Job %s (%s) cancelled on attempt %d", job.ID, job.Kind, job.Attempts)
+	if err := cfg.db.CancelJob(job.ID, errJobCancelled.Error()); err != nil {
+		log.Printf("Couldn't mark job %s cancelled: %v", job.ID, err)
+	}
+	cfg.settleVideo(job.VideoID, errJobCancelled)
+}
+
+// failJob schedules a retry with exponential backoff, or gives up once the job
+// is out of attempts or the error is permanent.
+func (cfg *apiConfig) failJob(job database.Job, jobErr error) {
+	log.Printf("Job %s (%s) failed on attempt %d: %v", job.ID, job.Kind, job.Attempts, jobErr)
+
+	var permErr permanentError
+	if errors.As(jobErr, &permErr) || job.Attempts >= job.MaxAttempts {
+		if err := cfg.db.FailJob(job.ID, jobErr.Error()); err != nil {
+			log.Printf("Couldn't mark job %s failed: %v", job.ID, err)
+		}
+		cfg.settleVideo(job.VideoID, jobErr)
+		return
+	}
+
+	backoff := min(jobInitialDelay<<(job.Attempts-1), jobMaxBackoff)
+	if err := cfg.db.RetryJob(job.ID, jobErr.Error(), time.Now().Add(backoff)); err != nil {
+		log.Printf("Couldn't reschedule job %s: %v", job.ID, err)
+	}
+}
+
+func (cfg *apiConfig) heartbeatJob(ctx context.Context, job database.Job, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(jobHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cancelRequested, err := cfg.db.TouchJob(job.ID)
+			if err != nil {
+				log.Printf("Couldn't refresh lock on job %s: %v", job.ID, err)
+				continue
+			}
+			if cancelRequested {
+				cancel(errJobCancelled)
+				return
+			}
+		}
+	}
+}
+
+func (cfg *apiConfig) requeueStaleJobs(ctx context.Context) {
+	ticker := time.NewTicker(jobLockTimeout)
+	defer ticker.Stop()
+
+	for {
+		n, err := cfg.db.RequeueStaleJobs(time.Now().Add(-jobLockTimeout))
+		if err != nil {
+			log.Printf("Couldn't requeue stale jobs: %v", err)
+		} else if n > 0 {
+			log.Printf("Requeued %d abandoned jobs", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireVideoUploads takes videos out of uploading when their upload hasn't been
+// completed in time, e.g. a presigned upload the client never finished, and removes
+// expired resumable uploads. Slower uploads that do finish later are still queued.
+func (cfg *apiConfig) expireVideoUploads(ctx context.Context) {
+	ticker := time.NewTicker(presignedUploadExpiry)
+	defer ticker.Stop()
+
+	for {
+		cfg.removeExpiredTusUploads()
+		n, err := cfg.db.ExpireVideoUploads(time.Now().Add(-presignedUploadExpiry))
+		if err != nil {
+			log.Printf("Couldn't expire video uploads: %v", err)
+		} else if n > 0 {
+			log.Printf("Reset %d videos whose upload was never completed", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -2,40 +2,65 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
-	db               database.Client
-	jwtSecret        string
-	platform         string
-	filepathRoot     string
-	assetsRoot       string
-	s3Client         *s3.Client
-	s3Bucket         string
-	s3Region         string
-	s3CfDistribution string
-	port             string
+	db                database.Client
+	jwtSecret         string
+	platform          string
+	filepathRoot      string
+	assetsRoot        string
+	assetStore        storage.ObjectStore
+	videoStore        storage.ObjectStore
+	storageBackend    string
+	tusUploads        *tusStore
+	progress          *progressHub
+	runningJobs       *runningJobs
+	media             media.Processor
+	mediaLimiter      *media.Limiter
+	processingWorkers int
+	maxQueuedJobs     int
+	hlsEnabled        bool
+	dashEnabled       bool
+	thumbnailOffset   time.Duration
+	previewsEnabled   bool
+	spriteInterval    time.Duration
+	loudnormEnabled   bool
+	loudnormTarget    int
+	audioRendition    string
+	watermark         *media.Watermark
+	s3Bucket          string
+	s3Region          string
+	s3CfDistribution  string
+	port              string
 }
 
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
-	if pathToDB == "" {
+	// DB_PATH is the older name, from when only SQLite was supported
+	dbURL := envString("DB_URL", os.Getenv("DB_PATH"))
+	if dbURL == "" {
 		log.Fatal("DB_URL must be set")
 	}
 
-	db, err := database.NewClient(pathToDB)
+	db, err := database.NewClient(dbURL)
 	if err != nil {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
@@ -60,43 +85,144 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable is not set")
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = "s3"
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
-	}
+	assetStore := storage.NewLocalStore(assetsRoot, fmt.Sprintf("http://localhost:%s/assets", port))
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	var videoStore storage.ObjectStore
+	var s3Bucket, s3Region, s3CfDistribution string
+	switch storageBackend {
+	case "s3":
+		s3Bucket = os.Getenv("S3_BUCKET")
+		if s3Bucket == "" {
+			log.Fatal("S3_BUCKET environment variable is not set")
+		}
+
+		s3Region = os.Getenv("S3_REGION")
+		if s3Region == "" {
+			log.Fatal("S3_REGION environment variable is not set")
+		}
+
+		s3CfDistribution = os.Getenv("S3_CF_DISTRO")
+		if s3CfDistribution == "" {
+			log.Fatal("S3_CF_DISTRO environment variable is not set")
+		}
+		// Raw uploads and originals share the bucket with what's published, only the
+		// distribution can keep them private
+		if !envBool("S3_PRIVATE_PREFIXES_CONFIRMED", false) {
+			log.Fatalf("Make sure S3_CF_DISTRO doesn't serve objects under %s, then set S3_PRIVATE_PREFIXES_CONFIRMED=true", strings.Join(privateKeyPrefixes, " or "))
+		}
+
+		awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+		if err != nil {
+			log.Fatalf("Couldn't load AWS SDK config: %v", err)
+		}
+		s3Opts := storage.DefaultS3Options()
+		s3Opts.MultipartThreshold = int64(envInt("S3_MULTIPART_THRESHOLD_MB", int(s3Opts.MultipartThreshold>>20))) << 20
+		s3Opts.PartSize = int64(envInt("S3_MULTIPART_PART_SIZE_MB", int(s3Opts.PartSize>>20))) << 20
+		s3Opts.Concurrency = envInt("S3_MULTIPART_CONCURRENCY", s3Opts.Concurrency)
+		s3Opts.MaxPartRetries = envInt("S3_MULTIPART_RETRIES", s3Opts.MaxPartRetries)
+		videoStore = storage.NewS3Store(s3.NewFromConfig(awsCfg), s3Bucket, s3CfDistribution, s3Opts)
+	case "local":
+		videoStore = assetStore
+	case "memory":
+		videoStore = storage.NewMemoryStore(fmt.Sprintf("http://localhost:%s/objects", port))
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q, expected s3, local or memory", storageBackend)
 	}
 
-	awsCfg, err := config.LoadDefaultConfig(context.Background())
+	tusUploadDir := os.Getenv("TUS_UPLOAD_DIR")
+	if tusUploadDir == "" {
+		tusUploadDir = filepath.Join(os.TempDir(), "tubely-tus")
+	}
+	tusUploads, err := newTusStore(tusUploadDir)
 	if err != nil {
-		log.Fatalf("Couldn't load AWS SDK config: %v", err)
+		log.Fatalf("Couldn't set up resumable uploads: %v", err)
 	}
-	s3Client := s3.NewFromConfig(awsCfg)
+
+	mediaProcessor := os.Getenv("MEDIA_PROCESSOR")
+	if mediaProcessor == "" {
+		mediaProcessor = "exec"
+	}
+
+	var processor media.Processor
+	var execProcessor *media.ExecProcessor
+	switch mediaProcessor {
+	case "exec":
+		execProcessor = media.NewExecProcessor(envString("FFMPEG_PATH", "ffmpeg"), envString("FFPROBE_PATH", "ffprobe"))
+		processor = execProcessor
+	case "fake":
+		// Its outputs are copies and placeholders published as if they were real
+		if platform != "dev" {
+			log.Fatal("MEDIA_PROCESSOR=fake is only allowed with PLATFORM=dev")
+		}
+		log.Print("WARNING: MEDIA_PROCESSOR=fake publishes copies of uploads and placeholder streams, previews and thumbnails instead of processing them")
+		processor = media.NewFakeProcessor()
+	default:
+		log.Fatalf("Unknown MEDIA_PROCESSOR %q, expected exec or fake", mediaProcessor)
+	}
+
+	audioRendition := envString("AUDIO_RENDITION", "aac")
+	if _, ok := audioRenditionExts[audioRendition]; !ok && audioRendition != "none" {
+		log.Fatalf("Unknown AUDIO_RENDITION %q, expected aac, mp3 or none", audioRendition)
+	}
+
+	// Applies to the videos of users without a watermark of their own
+	var watermark *media.Watermark
+	if watermarkImage := os.Getenv("WATERMARK_IMAGE"); watermarkImage != "" {
+		if _, err := os.Stat(watermarkImage); err != nil {
+			log.Fatalf("Couldn't read WATERMARK_IMAGE: %v", err)
+		}
+		watermark = &media.Watermark{
+			ImagePath: watermarkImage,
+			Position:  envString("WATERMARK_POSITION", defaultWatermarkPosition),
+			Opacity:   envFloat("WATERMARK_OPACITY", defaultWatermarkOpacity),
+			Scale:     envFloat("WATERMARK_SCALE", defaultWatermarkScale),
+		}
+		if err := validateWatermark(watermark.Position, watermark.Opacity, watermark.Scale); err != nil {
+			log.Fatalf("Invalid WATERMARK_* settings: %v", err)
+		}
+	}
+
+	mediaLimiter := media.NewLimiter(processor, envInt("MEDIA_CONCURRENCY", 2), envInt("MEDIA_INTERACTIVE_CONCURRENCY", 2))
 
 	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Client:         s3Client,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
+		db:                db,
+		jwtSecret:         jwtSecret,
+		platform:          platform,
+		filepathRoot:      filepathRoot,
+		assetsRoot:        assetsRoot,
+		assetStore:        assetStore,
+		videoStore:        videoStore,
+		storageBackend:    storageBackend,
+		tusUploads:        tusUploads,
+		progress:          newProgressHub(),
+		runningJobs:       newRunningJobs(),
+		media:             mediaLimiter,
+		mediaLimiter:      mediaLimiter,
+		processingWorkers: envInt("PROCESSING_WORKERS", 2),
+		maxQueuedJobs:     envInt("MAX_QUEUED_JOBS", 100),
+		hlsEnabled:        envBool("HLS_ENABLED", true),
+		dashEnabled:       envBool("DASH_ENABLED", false),
+		thumbnailOffset:   envDuration("THUMBNAIL_OFFSET", 3*time.Second),
+		previewsEnabled:   envBool("PREVIEWS_ENABLED", true),
+		spriteInterval:    envDuration("SPRITE_INTERVAL", 5*time.Second),
+		loudnormEnabled:   envBool("LOUDNORM_ENABLED", false),
+		loudnormTarget:    envInt("LOUDNORM_TARGET", -23),
+		audioRendition:    audioRendition,
+		watermark:         watermark,
+		s3Bucket:          s3Bucket,
+		s3Region:          s3Region,
+		s3CfDistribution:  s3CfDistribution,
+		port:              port,
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -104,13 +230,51 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	gcOpts := gcOptions{
+		DryRun:      envBool("GC_DRY_RUN", false),
+		GracePeriod: envDuration("GC_GRACE_PERIOD", 24*time.Hour),
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gc":
+			if err := cfg.runGCCommand(os.Args[2:], gcOpts); err != nil {
+				log.Fatalf("GC failed: %v", err)
+			}
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+		return
+	}
+
+	// Fail now rather than on the first upload when ffmpeg is missing or too old
+	if execProcessor != nil {
+		ffmpegVersion, ffprobeVersion, err := execProcessor.CheckVersions(context.Background())
+		if err != nil {
+			log.Fatalf("Couldn't use ffmpeg: %v", err)
+		}
+		log.Printf("Using ffmpeg %s and ffprobe %s", ffmpegVersion, ffprobeVersion)
+	}
+
+	go cfg.retryObjectDeletions(context.Background(), time.Minute)
+	go sweepTempFiles(context.Background(), time.Hour)
+	cfg.startJobWorkers(context.Background(), cfg.processingWorkers)
+
+	if gcInterval := envDuration("GC_INTERVAL", 0); gcInterval > 0 {
+		go cfg.scheduleGC(context.Background(), gcInterval, gcOpts)
+	}
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
+	assetsHandler := http.StripPrefix("/assets", hidePrivateObjects(http.FileServer(http.Dir(assetsRoot))))
 	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
 
+	if storageBackend == "memory" {
+		mux.Handle("/objects/", http.StripPrefix("/objects", objectStoreHandler(videoStore)))
+	}
+
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
@@ -120,8 +284,26 @@ func main() {
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/presign", cfg.handlerPresignVideoUpload)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/complete", cfg.handlerCompleteVideoUpload)
+	mux.HandleFunc("OPTIONS /api/video_upload/{videoID}/tus", cfg.handlerTusOptions)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/tus", cfg.handlerTusCreate)
+	mux.HandleFunc("HEAD /api/video_upload/{videoID}/tus/{uploadID}", cfg.handlerTusHead)
+	mux.HandleFunc("PATCH /api/video_upload/{videoID}/tus/{uploadID}", cfg.handlerTusPatch)
+	mux.HandleFunc("DELETE /api/video_upload/{videoID}/tus/{uploadID}", cfg.handlerTusDelete)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/events", cfg.handlerVideoEvents)
+	mux.HandleFunc("POST /api/videos/{videoID}/events/token", cfg.handlerVideoEventsToken)
+	mux.HandleFunc("POST /api/videos/{videoID}/cancel", cfg.handlerVideoCancelProcessing)
+	mux.HandleFunc("POST /api/videos/{videoID}/trim", cfg.handlerVideoTrim)
+	mux.HandleFunc("POST /api/videos/{videoID}/reprocess", cfg.handlerVideoReprocess)
+	mux.HandleFunc("POST /api/videos/{videoID}/captions", cfg.handlerUploadCaptions)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/captions/{language}", cfg.handlerDeleteCaptions)
+	mux.HandleFunc("GET /api/queue", cfg.handlerQueueGet)
+	mux.HandleFunc("GET /api/watermark", cfg.handlerWatermarkGet)
+	mux.HandleFunc("PUT /api/watermark", cfg.handlerWatermarkSet)
+	mux.HandleFunc("DELETE /api/watermark", cfg.handlerWatermarkDelete)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
@@ -134,3 +316,63 @@ func main() {
 	log.Printf("Serving on: http://localhost:%s/app/\n", port)
 	log.Fatal(srv.ListenAndServe())
 }
+
+// envString reads an optional environment variable, falling back to def when unset.
+func envString(name, def string) string {
+	if raw := os.Getenv(name); raw != "" {
+		return raw
+	}
+	return def
+}
+
+// envInt reads an optional integer environment variable, falling back to def when unset.
+func envInt(name string, def int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Fatalf("%s must be an integer: %v", name, err)
+	}
+	return n
+}
+
+// envFloat reads an optional decimal environment variable, falling back to def when unset.
+func envFloat(name string, def float64) float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Fatalf("%s must be a number: %v", name, err)
+	}
+	return f
+}
+
+// envDuration reads an optional duration environment variable such as "90s" or "24h".
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Fatalf("%s must be a duration: %v", name, err)
+	}
+	return d
+}
+
+// envBool reads an optional boolean environment variable.
+func envBool(name string, def bool) bool {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Fatalf("%s must be true or false: %v", name, err)
+	}
+	return b
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+const (
+	previewWidth       = 320
+	previewFPS         = 10
+	previewMaxDuration = 3 * time.Second
+
+	spriteWidth   = 160
+	spriteColumns = 10
+	spriteRows    = 10
+)
+
+// publishPreviews generates an animated preview and a sprite sheet thumbnail track
+// for the video at filePath, stores them next to objKey and fills in their URLs on
+// outputs. They're extras, so failing to make them only fails processing when it
+// was cancelled.
+func (cfg *apiConfig) publishPreviews(ctx context.Context, filePath, objKey string, probe media.Probe, outputs *database.VideoOutputs) error {
+	if !cfg.previewsEnabled {
+		return nil
+	}
+
+	workDir, err := os.MkdirTemp("", tempFilePrefix+"-previews-*")
+	if err != nil {
+		log.Printf("Couldn't create previews work directory: %v", err)
+		return nil
+	}
+	defer os.RemoveAll(workDir)
+
+	previewURL, err := cfg.publishAnimatedPreview(ctx, filePath, workDir, objKey, probe)
+	if err != nil {
+		log.Printf("Couldn't generate animated preview for %s: %v", objKey, err)
+	} else {
+		outputs.PreviewURL = &previewURL
+	}
+
+	trackURL, err := cfg.publishSpriteSheets(ctx, filePath, workDir, objKey, probe)
+	if err != nil {
+		log.Printf("Couldn't generate sprite sheets for %s: %v", objKey, err)
+	} else {
+		outputs.ThumbnailTrackURL = &trackURL
+	}
+	return ctx.Err()
+}
+
+// publishAnimatedPreview makes a short clip from early in the video, skipping intros
+// that tend to be black. WebP is smaller, GIF is the fallback for ffmpeg builds without it.
+func (cfg *apiConfig) publishAnimatedPreview(ctx context.Context, filePath, workDir, objKey string, probe media.Probe) (string, error) {
+	duration := time.Duration(probe.DurationSeconds * float64(time.Second))
+	opts := media.PreviewOptions{
+		Start:    duration / 10,
+		Duration: min(previewMaxDuration, duration-duration/10),
+		Width:    previewWidth,
+		FPS:      previewFPS,
+	}
+	if opts.Duration <= 0 {
+		return "", errors.New("video is too short")
+	}
+
+	var previewPath string
+	var err error
+	for _, ext := range []string{".webp", ".gif"} {
+		previewPath = filepath.Join(workDir, "preview"+ext)
+		if err = cfg.media.AnimatedPreview(ctx, filePath, previewPath, opts); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(previewPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	key := derivedKeyPrefix(objKey) + filepath.Base(previewPath)
+	if err := cfg.videoStore.Put(ctx, key, f, streamingContentType(previewPath)); err != nil {
+		return "", fmt.Errorf("error uploading preview: %w", err)
+	}
+	return cfg.videoStore.URL(key), nil
+}
+
+// publishSpriteSheets tiles a frame every spriteInterval into sheets and writes a
+// WebVTT track whose cues point at each frame's area of its sheet, which players
+// show as seek bar thumbnails.
+func (cfg *apiConfig) publishSpriteSheets(ctx context.Context, filePath, workDir, objKey string, probe media.Probe) (string, error) {
+	if cfg.spriteInterval <= 0 {
+		return "", errors.New("SPRITE_INTERVAL must be positive")
+	}
+	width, height := probe.DisplaySize()
+	if width <= 0 || height <= 0 {
+		return "", errors.New("video has no frame size")
+	}
+	opts := media.SpriteOptions{
+		Interval: cfg.spriteInterval,
+		Width:    spriteWidth,
+		// Even, as the sheets are encoded as YUV 4:2:0
+		Height:  max(2, spriteWidth*height/width/2*2),
+		Columns: spriteColumns,
+		Rows:    spriteRows,
+	}
+
+	spritesDir := filepath.Join(workDir, "sprites")
+	if err := os.Mkdir(spritesDir, 0o755); err != nil {
+		return "", err
+	}
+	if err := cfg.media.SpriteSheets(ctx, filePath, filepath.Join(spritesDir, "sprite-%d.jpg"), opts); err != nil {
+		return "", err
+	}
+
+	sheets := 0
+	for {
+		if _, err := os.Stat(filepath.Join(spritesDir, spriteSheetName(sheets))); err != nil {
+			break
+		}
+		sheets++
+	}
+	if sheets == 0 {
+		return "", errors.New("no sprite sheets were written")
+	}
+
+	duration := time.Duration(probe.DurationSeconds * float64(time.Second))
+	track := thumbnailTrack(duration, sheets, opts)
+	if err := os.WriteFile(filepath.Join(spritesDir, "thumbnails.vtt"), track, 0o644); err != nil {
+		return "", err
+	}
+
+	keyPrefix := derivedKeyPrefix(objKey) + "sprites"
+	if err := cfg.putDir(ctx, spritesDir, keyPrefix); err != nil {
+		return "", fmt.Errorf("error uploading sprite sheets: %w", err)
+	}
+	return cfg.videoStore.URL(path.Join(keyPrefix, "thumbnails.vtt")), nil
+}
+
+func spriteSheetName(i int) string {
+	return fmt.Sprintf("sprite-%d.jpg", i)
+}
+
+// thumbnailTrack returns a WebVTT track with a cue per sprite frame. Cue URLs are
+// relative to the track, so the sheets are found wherever the track is served from.
+func thumbnailTrack(duration time.Duration, sheets int, opts media.SpriteOptions) []byte {
+	var out bytes.Buffer
+	out.WriteString("WEBVTT\n")
+
+	perSheet := opts.Columns * opts.Rows
+	for i := 0; i < sheets*perSheet; i++ {
+		start := time.Duration(i) * opts.Interval
+		if start >= duration {
+			break
+		}
+		end := min(start+opts.Interval, duration)
+		tile := i % perSheet
+		x := tile % opts.Columns * opts.Width
+		y := tile / opts.Columns * opts.Height
+		fmt.Fprintf(&out, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			formatVTTTimestamp(start), formatVTTTimestamp(end), spriteSheetName(i/perSheet), x, y, opts.Width, opts.Height)
+	}
+	return out.Bytes()
+}
+
+// formatVTTTimestamp formats d as "HH:MM:SS.mmm".
+func formatVTTTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/google/uuid"
+)
+
+// progressEvent is how far along processing of a video is.
+type progressEvent struct {
+	VideoID uuid.UUID `json:"video_id"`
+	// The ffmpeg step currently running, e.g. "transcoding" or "renditions"
+	Stage string `json:"stage"`
+	// Across all the steps of the job, 0-100
+	Percent float64 `json:"percent"`
+	// Sent once a job is over, whether or not it succeeded. Stage and Percent are unset.
+	Done bool `json:"-"`
+}
+
+// progressHub fans processing progress out to whoever is watching a video. It's
+// in memory, so only jobs running in this process are reported.
+type progressHub struct {
+	mu          sync.Mutex
+	subscribers map[uuid.UUID]map[chan progressEvent]struct{}
+	latest      map[uuid.UUID]progressEvent
+}
+
+func newProgressHub() *progressHub {
+	return &progressHub{
+		subscribers: map[uuid.UUID]map[chan progressEvent]struct{}{},
+		latest:      map[uuid.UUID]progressEvent{},
+	}
+}
+
+// subscribe returns a channel of progress events for videoID, starting with the
+// latest one if the video is being processed. Call unsubscribe when done.
+func (h *progressHub) subscribe(videoID uuid.UUID) (events <-chan progressEvent, unsubscribe func()) {
+	ch := make(chan progressEvent, 16)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[videoID] == nil {
+		h.subscribers[videoID] = map[chan progressEvent]struct{}{}
+	}
+	h.subscribers[videoID][ch] = struct{}{}
+	if event, ok := h.latest[videoID]; ok {
+		ch <- event
+	}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers[videoID], ch)
+		if len(h.subscribers[videoID]) == 0 {
+			delete(h.subscribers, videoID)
+		}
+	}
+}
+
+func (h *progressHub) publish(event progressEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if event.Done {
+		delete(h.latest, event.VideoID)
+	} else {
+		h.latest[event.VideoID] = event
+	}
+	for ch := range h.subscribers[event.VideoID] {
+		select {
+		case ch <- event:
+		default:
+			// A slow client misses intermediate updates rather than holding up ffmpeg
+		}
+	}
+}
+
+// processingProgress turns the progress of a job's individual ffmpeg steps into
+// an overall percentage, counting every step as the same amount of work.
+type processingProgress struct {
+	hub     *progressHub
+	videoID uuid.UUID
+	steps   int
+	done    int
+	stage   string
+	// Last percentage published, to avoid flooding subscribers with tiny steps
+	published float64
+}
+
+func (cfg *apiConfig) newProcessingProgress(videoID uuid.UUID, steps int) *processingProgress {
+	return &processingProgress{hub: cfg.progress, videoID: videoID, steps: max(steps, 1), published: -1}
+}
+
+// step starts the next step, which works through durationSeconds of video, and
+// returns what reports its progress. A nil *processingProgress ignores everything.
+func (p *processingProgress) step(stage string, durationSeconds float64) media.Progress {
+	if p == nil {
+		return media.Progress{}
+	}
+	if p.stage != "" {
+		p.done = min(p.done+1, p.steps)
+	}
+	p.stage = stage
+	p.report(0)
+	return media.Progress{DurationSeconds: durationSeconds, Report: p.report}
+}
+
+func (p *processingProgress) report(fraction float64) {
+	percent := (float64(p.done) + min(max(fraction, 0), 1)) / float64(p.steps) * 100
+	if percent < 100 && percent-p.published < 1 {
+		return
+	}
+	p.published = percent
+	p.hub.publish(progressEvent{VideoID: p.videoID, Stage: p.stage, Percent: percent})
+}
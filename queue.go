@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How long clients turned away by a full processing queue are asked to wait
+const queueFullRetryAfter = time.Minute
+
+var errQueueFull = errors.New("processing queue is full")
+
+// checkQueueCapacity returns errQueueFull when maxQueuedJobs videos are already
+// waiting for processing. Callers check before accepting an upload, so a burst of
+// uploads is turned away up front rather than piling up behind the workers.
+func (cfg *apiConfig) checkQueueCapacity() error {
+	if cfg.maxQueuedJobs <= 0 {
+		return nil
+	}
+	queued, err := cfg.db.CountQueuedJobs()
+	if err != nil {
+		return fmt.Errorf("error counting queued jobs: %w", err)
+	}
+	if queued >= cfg.maxQueuedJobs {
+		return fmt.Errorf("%w: %d videos waiting", errQueueFull, queued)
+	}
+	return nil
+}
+
+// respondQueueFull responds to an error from checkQueueCapacity.
+func respondQueueFull(w http.ResponseWriter, err error) {
+	if errors.Is(err, errQueueFull) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(queueFullRetryAfter.Seconds())))
+		respondWithError(w, http.StatusServiceUnavailable, "Too many videos are waiting to be processed, try again later", err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Couldn't check processing queue", err)
+}
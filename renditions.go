@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// rendition is one rung of the adaptive bitrate ladder. Size is the length of the
+// shorter side, so portrait videos get the same quality steps as landscape ones.
+type rendition struct {
+	Name         string
+	Size         int
+	VideoBitrate string
+	MaxRate      string
+	BufSize      string
+	AudioBitrate string
+}
+
+var renditionLadder = []rendition{
+	{Name: "1080p", Size: 1080, VideoBitrate: "5000k", MaxRate: "5350k", BufSize: "7500k", AudioBitrate: "192k"},
+	{Name: "720p", Size: 720, VideoBitrate: "2800k", MaxRate: "2996k", BufSize: "4200k", AudioBitrate: "128k"},
+	{Name: "480p", Size: 480, VideoBitrate: "1400k", MaxRate: "1498k", BufSize: "2100k", AudioBitrate: "128k"},
+	{Name: "360p", Size: 360, VideoBitrate: "800k", MaxRate: "856k", BufSize: "1200k", AudioBitrate: "96k"},
+}
+
+// Segment length for both HLS and DASH
+const segmentSeconds = 6
+
+// Seconds between keyframes, identical across renditions so players can switch
+// between them. Segments are cut on keyframes, so it divides segmentSeconds.
+const keyframeSeconds = 2
+
+// renditionGOP is the keyframe interval in frames that puts a keyframe every
+// keyframeSeconds at the source's frame rate, assuming 24 fps when it's unknown.
+func renditionGOP(probe media.Probe) int {
+	frameRate := probe.FrameRate
+	if frameRate <= 0 {
+		frameRate = 24
+	}
+	return max(1, int(math.Round(frameRate*keyframeSeconds)))
+}
+
+// ladderFor drops the renditions that would upscale the source.
+func ladderFor(probe media.Probe) []rendition {
+	shortSide := min(probe.DisplaySize())
+	ladder := []rendition{}
+	for _, r := range renditionLadder {
+		if r.Size <= shortSide {
+			ladder = append(ladder, r)
+		}
+	}
+	if len(ladder) == 0 {
+		ladder = append(ladder, renditionLadder[len(renditionLadder)-1])
+	}
+	return ladder
+}
+
+// encodeRenditions transcodes the source once per rendition into workDir. The results
+// are packaged for streaming without being re-encoded.
+func (cfg *apiConfig) encodeRenditions(ctx context.Context, srcPath, workDir string, probe media.Probe, progress *processingProgress) ([]media.Rendition, error) {
+	// ffmpeg applies the rotation while decoding, so the renditions come out upright
+	scale := "scale=-2:%d"
+	if width, height := probe.DisplaySize(); height > width {
+		scale = "scale=%d:-2"
+	}
+
+	encoded := []media.Rendition{}
+	for _, r := range ladderFor(probe) {
+		outPath := filepath.Join(workDir, r.Name+".mp4")
+		opts := media.TranscodeOptions{
+			VideoCodec:   "libx264",
+			Preset:       "veryfast",
+			Profile:      "main",
+			VideoBitrate: r.VideoBitrate,
+			MaxRate:      r.MaxRate,
+			BufSize:      r.BufSize,
+			GOP:          renditionGOP(probe),
+			VideoFilter:  fmt.Sprintf(scale, r.Size),
+			FastStart:    true,
+		}
+		if probe.HasAudio {
+			opts.AudioCodec = "aac"
+			opts.AudioBitrate = r.AudioBitrate
+			opts.AudioChannels = 2
+		}
+
+		if err := cfg.media.Transcode(ctx, srcPath, outPath, opts, progress.step("encoding "+r.Name, probe.DurationSeconds)); err != nil {
+			return nil, fmt.Errorf("error encoding %s rendition: %w", r.Name, err)
+		}
+		encoded = append(encoded, media.Rendition{Name: r.Name, Path: outPath})
+	}
+	return encoded, nil
+}
+
+// publishStreams encodes the adaptive bitrate ladder for the video at filePath once,
+// packages it for every enabled streaming format, stores the results next to objKey
+// and fills in their manifest URLs on outputs.
+func (cfg *apiConfig) publishStreams(ctx context.Context, filePath, objKey string, probe media.Probe, outputs *database.VideoOutputs, progress *processingProgress) error {
+	if !cfg.hlsEnabled && !cfg.dashEnabled {
+		return nil
+	}
+
+	workDir, err := os.MkdirTemp("", tempFilePrefix+"-renditions-*")
+	if err != nil {
+		return fmt.Errorf("error creating work directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	renditions, err := cfg.encodeRenditions(ctx, filePath, workDir, probe, progress)
+	if err != nil {
+		return err
+	}
+
+	packageOpts := media.PackageOptions{HasAudio: probe.HasAudio, SegmentSeconds: segmentSeconds}
+	if cfg.hlsEnabled {
+		hlsDir := filepath.Join(workDir, "hls")
+		masterPlaylist, err := cfg.media.PackageHLS(ctx, renditions, hlsDir, packageOpts)
+		if err != nil {
+			return err
+		}
+
+		hlsKeyPrefix := derivedKeyPrefix(objKey) + "hls"
+		if err := cfg.putDir(ctx, hlsDir, hlsKeyPrefix); err != nil {
+			return fmt.Errorf("error uploading HLS renditions: %w", err)
+		}
+		hlsURL := cfg.videoStore.URL(path.Join(hlsKeyPrefix, masterPlaylist))
+		outputs.HLSURL = &hlsURL
+	}
+
+	if cfg.dashEnabled {
+		dashDir := filepath.Join(workDir, "dash")
+		manifest, err := cfg.media.PackageDASH(ctx, renditions, dashDir, packageOpts)
+		if err != nil {
+			return err
+		}
+
+		dashKeyPrefix := derivedKeyPrefix(objKey) + "dash"
+		if err := cfg.putDir(ctx, dashDir, dashKeyPrefix); err != nil {
+			return fmt.Errorf("error uploading DASH renditions: %w", err)
+		}
+		dashURL := cfg.videoStore.URL(path.Join(dashKeyPrefix, manifest))
+		outputs.DASHURL = &dashURL
+	}
+	return nil
+}
+
+// putDir uploads every file under dir to the video store below keyPrefix.
+func (cfg *apiConfig) putDir(ctx context.Context, dir, keyPrefix string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		key := path.Join(keyPrefix, filepath.ToSlash(rel))
+		return cfg.videoStore.Put(ctx, key, f, streamingContentType(p))
+	})
+}
+
+func streamingContentType(filePath string) string {
+	switch filepath.Ext(filePath) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	case ".m4s":
+		return "video/iso.segment"
+	case ".mpd":
+		return "application/dash+xml"
+	case ".mp4":
+		return "video/mp4"
+	case ".m4a":
+		return "audio/mp4"
+	case ".mp3":
+		return "audio/mpeg"
+	case ".vtt":
+		return captionMediaType
+	}
+	if t := mime.TypeByExtension(filepath.Ext(filePath)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
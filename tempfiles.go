@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tempFilePrefix starts the name of every temp file and directory uploads and
+// processing create, so leftovers can be found again.
+const tempFilePrefix = "tubely-upload"
+
+// Processing removes its own temp files however it ends, but a crash or kill
+// leaves them behind. Jobs can run for a long time and other instances on the
+// same host share the temp dir, so only files this old are swept.
+const staleTempFileAge = 24 * time.Hour
+
+// sweepTempFiles removes stale temp files now and then every interval until ctx is done.
+func sweepTempFiles(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		removeStaleTempFiles(time.Now().Add(-staleTempFileAge))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func removeStaleTempFiles(modifiedBefore time.Time) {
+	entries, err := os.ReadDir(os.TempDir())
+	if err != nil {
+		log.Printf("Couldn't list temp dir: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(modifiedBefore) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(os.TempDir(), entry.Name())); err != nil {
+			log.Printf("Couldn't remove stale temp file %s: %v", entry.Name(), err)
+		}
+	}
+}
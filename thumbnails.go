@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+const thumbnailMediaType = "image/jpeg"
+
+// Drops frames that are at least 90% black, then lets ffmpeg's thumbnail filter pick
+// the most representative frame of the next batch
+const skipBlackFramesFilter = "blackframe=amount=0:threshold=32," +
+	"metadata=select:key=lavfi.blackframe.pblack:value=90:function=less," +
+	"thumbnail=50"
+
+// generateThumbnail gives a video without a thumbnail one taken from its own frames.
+// A thumbnail the user uploads in the meantime always wins.
+func (cfg *apiConfig) generateThumbnail(ctx context.Context, video database.Video, videoPath string) error {
+	workDir, err := os.MkdirTemp("", tempFilePrefix+"-thumbnail-*")
+	if err != nil {
+		return fmt.Errorf("error creating work directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+	framePath := filepath.Join(workDir, "frame.jpg")
+
+	// Short videos may end before the offset, and some are black throughout
+	attempts := []struct {
+		offset    time.Duration
+		skipBlack bool
+	}{
+		{cfg.thumbnailOffset, true},
+		{0, true},
+		{0, false},
+	}
+	for _, attempt := range attempts {
+		opts := media.FrameOptions{Offset: attempt.offset, Quality: 3}
+		if attempt.skipBlack {
+			opts.VideoFilter = skipBlackFramesFilter
+		}
+		err = cfg.media.ExtractFrame(ctx, videoPath, framePath, opts)
+		if !errors.Is(err, media.ErrNoFrame) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	frame, err := os.ReadFile(framePath)
+	if err != nil {
+		return fmt.Errorf("error reading extracted frame: %w", err)
+	}
+
+	thumbnail, err := cfg.storeThumbnail(ctx, frame, thumbnailMediaType)
+	if err != nil {
+		return fmt.Errorf("error saving thumbnail: %w", err)
+	}
+
+	set, err := cfg.db.SetVideoThumbnailIfUnset(video.ID, thumbnail.URL, thumbnail.Srcset)
+	if err != nil {
+		return fmt.Errorf("error updating video: %w", err)
+	}
+	if !set {
+		refs := []database.ObjectRef{
+			{Store: assetStoreName, Key: thumbnail.Key},
+			{Store: assetStoreName, Key: derivedKeyPrefix(thumbnail.Key), IsPrefix: true},
+		}
+		for _, ref := range refs {
+			if err := cfg.deleteObjectRef(ctx, ref); err != nil {
+				log.Printf("Couldn't delete unused thumbnail %s: %v", ref.Key, err)
+			}
+		}
+	}
+	return nil
+}
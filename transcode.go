@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// uploadFormatNames are the ffprobe demuxers behind uploadVideoTypes. ffprobe
+// reports every name a demuxer goes by, e.g. "mov,mp4,m4a,3gp,3g2,mj2" or "matroska,webm".
+var uploadFormatNames = []string{"mov", "mp4", "matroska", "webm"}
+
+// validateUploadedVideo probes a raw upload and checks it's a video in one of the
+// containers we accept. The error wraps errUnsupportedVideoType when the file is
+// at fault rather than ffprobe.
+func (cfg *apiConfig) validateUploadedVideo(ctx context.Context, filePath string) (media.Probe, error) {
+	probe, err := cfg.media.Probe(ctx, filePath)
+	if err != nil {
+		if errors.Is(err, media.ErrInvalidMedia) {
+			return media.Probe{}, fmt.Errorf("%w: %v", errUnsupportedVideoType, err)
+		}
+		return media.Probe{}, fmt.Errorf("error probing video: %w", err)
+	}
+
+	for _, name := range strings.Split(probe.FormatName, ",") {
+		if slices.Contains(uploadFormatNames, name) {
+			return probe, nil
+		}
+	}
+	return media.Probe{}, fmt.Errorf("%w: %s", errUnsupportedVideoType, probe.FormatName)
+}
+
+// needsTranscode reports whether a probed upload has to be re-encoded before it
+// can be published. MOV and MP4 files that are already H.264/AAC only need the
+// remux processVideoForFastStart does anyway.
+func needsTranscode(probe media.Probe) bool {
+	isMP4Family := slices.Contains(strings.Split(probe.FormatName, ","), "mp4")
+	return !isMP4Family || !isMP4VideoCodec(probe.VideoCodec) || (probe.HasAudio && !isMP4AudioCodec(probe.AudioCodec))
+}
+
+func isMP4VideoCodec(codec string) bool {
+	return codec == "h264"
+}
+
+func isMP4AudioCodec(codec string) bool {
+	return codec == "aac"
+}
+
+// transcodeToMP4 converts an upload to an H.264/AAC MP4, copying whichever
+// streams are already in the right codec, and returns the new file's path.
+func (cfg *apiConfig) transcodeToMP4(ctx context.Context, filePath string, probe media.Probe, progress media.Progress) (string, error) {
+	outputFilePath := filePath + ".transcoded.mp4"
+
+	opts := media.TranscodeOptions{VideoCodec: "copy"}
+	if !isMP4VideoCodec(probe.VideoCodec) {
+		encodeH264(&opts)
+	}
+	if probe.HasAudio {
+		opts.AudioCodec = "copy"
+		if !isMP4AudioCodec(probe.AudioCodec) {
+			encodeAAC(&opts)
+		}
+	}
+
+	if err := cfg.media.Transcode(ctx, filePath, outputFilePath, opts, progress); err != nil {
+		return "", fmt.Errorf("error transcoding to MP4: %w", err)
+	}
+	return outputFilePath, nil
+}
+
+// encodeH264 sets opts to re-encode the video the way uploads are published.
+func encodeH264(opts *media.TranscodeOptions) {
+	opts.VideoCodec = "libx264"
+	opts.Preset = "veryfast"
+	opts.CRF = 20
+	// iPhone HDR and VP9 profile 2 sources are 10-bit, which most players can't decode as H.264
+	opts.PixelFormat = "yuv420p"
+}
+
+func encodeAAC(opts *media.TranscodeOptions) {
+	opts.AudioCodec = "aac"
+	opts.AudioBitrate = "160k"
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const jobKindTrimVideo = "trim_video"
+
+type trimVideoPayload struct {
+	// The published video the trim was requested for. The cut is made from the
+	// video's original if it has one, so a watermark isn't burned in twice.
+	SourceKey string        `json:"source_key"`
+	Start     time.Duration `json:"start"`
+	// 0 keeps everything after Start
+	End time.Duration `json:"end"`
+}
+
+// clipTimestamp is a position in a video, given in JSON either as a number of
+// seconds or as a "[[HH:]MM:]SS[.mmm]" string.
+type clipTimestamp time.Duration
+
+func (t *clipTimestamp) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		return t.setSeconds(seconds)
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("timestamp must be a number of seconds or a string like \"01:30.5\"")
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return fmt.Errorf("invalid timestamp %q", s)
+	}
+	seconds = 0
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(part, 64)
+		// Only the seconds may have a fraction
+		if err != nil || value < 0 || (i < len(parts)-1 && value != math.Trunc(value)) {
+			return fmt.Errorf("invalid timestamp %q", s)
+		}
+		seconds = seconds*60 + value
+	}
+	return t.setSeconds(seconds)
+}
+
+func (t *clipTimestamp) setSeconds(seconds float64) error {
+	if seconds < 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return fmt.Errorf("invalid timestamp %v", seconds)
+	}
+	*t = clipTimestamp(time.Duration(math.Round(seconds*1000)) * time.Millisecond)
+	return nil
+}
+
+func (cfg *apiConfig) handleTrimVideoJob(ctx context.Context, job database.Job) error {
+	var payload trimVideoPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return permanent(fmt.Errorf("error decoding job payload: %w", err))
+	}
+
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return fmt.Errorf("error getting video: %w", err)
+	}
+	if video.ID == uuid.Nil {
+		return nil
+	}
+	if video.VideoURL == nil {
+		return permanent(errors.New("video has nothing to trim"))
+	}
+	if key, ok := storage.KeyFromURL(cfg.videoStore, *video.VideoURL); !ok || key != payload.SourceKey {
+		return permanent(errors.New("video was replaced before it could be trimmed"))
+	}
+	ctx = media.WithOwner(ctx, video.UserID.String())
+
+	if err := cfg.db.SetVideoStatus(video.ID, database.VideoStatusProcessing, ""); err != nil {
+		return fmt.Errorf("error updating video status: %w", err)
+	}
+
+	tempFile, err := os.CreateTemp("", tempFilePrefix)
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	sourceKey := payload.SourceKey
+	if video.OriginalKey != nil {
+		sourceKey = *video.OriginalKey
+	}
+	if err := cfg.downloadObject(ctx, sourceKey, tempFile); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return permanent(err)
+		}
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("error writing temp file: %w", err)
+	}
+
+	probe, err := cfg.media.Probe(ctx, tempFile.Name())
+	if err != nil {
+		return fmt.Errorf("error probing video: %w", err)
+	}
+	duration := time.Duration(probe.DurationSeconds * float64(time.Second))
+	if payload.End <= 0 || payload.End > duration {
+		payload.End = duration
+	}
+	if payload.Start >= payload.End {
+		return permanent(fmt.Errorf("trim starts at %v, after the video ends at %v", payload.Start, payload.End))
+	}
+
+	trimmedSeconds := (payload.End - payload.Start).Seconds()
+	progress := cfg.newProcessingProgress(video.ID, 1+cfg.processingSteps(probe))
+	trimmedPath, err := cfg.trimToMP4(ctx, tempFile.Name(), probe, payload.Start, payload.End, progress.step("trimming", trimmedSeconds))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(trimmedPath)
+
+	watermark, removeWatermark, err := cfg.videoWatermark(ctx, video.UserID)
+	if err != nil {
+		return err
+	}
+	defer removeWatermark()
+
+	trimmedProbe := probe
+	trimmedProbe.DurationSeconds = trimmedSeconds
+	outputs, err := cfg.processVideoFile(ctx, trimmedPath, trimmedProbe, watermark, progress)
+	if err != nil {
+		return err
+	}
+	// The trimmed cut is what the video is reprocessed from from now on
+	originalKey, err := originalObjectKey(video.ID, videoMediaType)
+	if err != nil {
+		return err
+	}
+	trimmedFile, err := os.Open(trimmedPath)
+	if err != nil {
+		return fmt.Errorf("error reading trimmed video: %w", err)
+	}
+	defer trimmedFile.Close()
+	if err := cfg.videoStore.Put(ctx, originalKey, trimmedFile, videoMediaType); err != nil {
+		return fmt.Errorf("error storing original: %w", err)
+	}
+	outputs.OriginalKey = &originalKey
+	captions, err := cfg.trimCaptions(ctx, video, payload.Start, payload.End-payload.Start)
+	if err != nil {
+		return err
+	}
+	if err := cfg.db.SetVideoOutputs(video.ID, outputs); err != nil {
+		return fmt.Errorf("error updating video: %w", err)
+	}
+	cfg.publishTrimmedCaptions(ctx, video.ID, captions)
+	if err := cfg.db.SetVideoStatus(video.ID, database.VideoStatusReady, ""); err != nil {
+		return fmt.Errorf("error updating video status: %w", err)
+	}
+
+	cfg.replaceVideoObjects(ctx, video, outputs, "")
+	return nil
+}
+
+// trimmedCaption is a caption track retimed for a trimmed video, stored but not
+// yet published.
+type trimmedCaption struct {
+	previous database.CaptionTrack
+	key      string
+}
+
+// trimCaptions stores a copy of each of the video's caption tracks retimed for the
+// cut from start that lasts length.
+func (cfg *apiConfig) trimCaptions(ctx context.Context, video database.Video, start, length time.Duration) ([]trimmedCaption, error) {
+	trimmed := []trimmedCaption{}
+	for _, track := range video.Captions {
+		key, ok := storage.KeyFromURL(cfg.videoStore, track.URL)
+		if !ok {
+			continue
+		}
+		body, err := cfg.videoStore.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("error downloading %s captions: %w", track.Language, err)
+		}
+		vtt, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error downloading %s captions: %w", track.Language, err)
+		}
+
+		assetPath, err := getAssetPath(captionMediaType)
+		if err != nil {
+			return nil, fmt.Errorf("error creating object key: %w", err)
+		}
+		trimmedKey := path.Join(captionsKeyPrefix(video.ID), assetPath)
+		if err := cfg.videoStore.Put(ctx, trimmedKey, bytes.NewReader(trimWebVTT(vtt, start, length)), captionMediaType); err != nil {
+			return nil, fmt.Errorf("error uploading %s captions: %w", track.Language, err)
+		}
+		trimmed = append(trimmed, trimmedCaption{previous: track, key: trimmedKey})
+	}
+	return trimmed, nil
+}
+
+// publishTrimmedCaptions points the video's tracks at their retimed copies and
+// deletes the old ones. Tracks the user replaced in the meantime are left alone,
+// their copy is deleted instead.
+func (cfg *apiConfig) publishTrimmedCaptions(ctx context.Context, videoID uuid.UUID, captions []trimmedCaption) {
+	for _, caption := range captions {
+		replaced, err := cfg.db.ReplaceVideoCaptionURL(videoID, caption.previous.Language, caption.previous.URL, cfg.videoStore.URL(caption.key))
+		if err != nil {
+			log.Printf("Couldn't update %s captions of video %s: %v", caption.previous.Language, videoID, err)
+		}
+		if replaced {
+			cfg.deleteCaptionTrack(ctx, caption.previous)
+		} else {
+			cfg.deleteCaptionTrack(ctx, database.CaptionTrack{URL: cfg.videoStore.URL(caption.key)})
+		}
+	}
+}
+
+// trimToMP4 cuts a video down to [start, end) and returns the new MP4's path. A cut
+// starting on a keyframe copies the streams, which is fast and lossless; anywhere
+// else the video has to be re-encoded to start with a keyframe. The end needs no
+// keyframe, copying simply stops there. Streams MP4 can't hold are re-encoded anyway.
+func (cfg *apiConfig) trimToMP4(ctx context.Context, filePath string, probe media.Probe, start, end time.Duration, progress media.Progress) (string, error) {
+	outputFilePath := filePath + ".trimmed.mp4"
+
+	aligned := start == 0
+	if !aligned {
+		keyframes, err := cfg.media.Keyframes(ctx, filePath)
+		if err != nil {
+			return "", fmt.Errorf("error finding keyframes: %w", err)
+		}
+		aligned = isKeyframeAligned(start, keyframes, probe.FrameRate)
+	}
+
+	opts := media.TranscodeOptions{VideoCodec: "copy", Start: start, End: end}
+	if probe.HasAudio {
+		opts.AudioCodec = "copy"
+	}
+	if !aligned || !isMP4VideoCodec(probe.VideoCodec) {
+		encodeH264(&opts)
+	}
+	if probe.HasAudio && (!aligned || !isMP4AudioCodec(probe.AudioCodec)) {
+		encodeAAC(&opts)
+	}
+
+	if err := cfg.media.Transcode(ctx, filePath, outputFilePath, opts, progress); err != nil {
+		return "", fmt.Errorf("error trimming video: %w", err)
+	}
+	return outputFilePath, nil
+}
+
+// isKeyframeAligned reports whether t is within half a frame of a keyframe.
+func isKeyframeAligned(t time.Duration, keyframes []time.Duration, frameRate float64) bool {
+	tolerance := 20 * time.Millisecond
+	if frameRate > 0 {
+		tolerance = time.Duration(float64(time.Second) / frameRate / 2)
+	}
+	for _, keyframe := range keyframes {
+		if (keyframe - t).Abs() <= tolerance {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// newReadyVideo uploads and processes a video, returning an access token for its
+// owner and the published video.
+func newReadyVideo(t *testing.T, cfg *apiConfig) (string, database.Video) {
+	t.Helper()
+	token, video := newTestVideo(t, cfg)
+	if rec := uploadVideo(t, cfg, token, video.ID, "video/mp4", []byte("an mp4")); rec.Code != http.StatusAccepted {
+		t.Fatalf("Upload responded %d: %s", rec.Code, rec.Body)
+	}
+	runNextJob(t, cfg)
+	video = getVideo(t, cfg, video.ID)
+	if video.Status != database.VideoStatusReady {
+		t.Fatalf("Status after processing = %q, want %q", video.Status, database.VideoStatusReady)
+	}
+	return token, video
+}
+
+func enqueueTrim(t *testing.T, cfg *apiConfig, video database.Video, start, end time.Duration) {
+	t.Helper()
+	key, _ := storage.KeyFromURL(cfg.videoStore, *video.VideoURL)
+	if _, err := cfg.enqueueVideoJob(video.ID, jobKindTrimVideo, trimVideoPayload{SourceKey: key, Start: start, End: end}); err != nil {
+		t.Fatalf("Couldn't enqueue trim: %v", err)
+	}
+}
+
+func TestTrimVideoRetimesCaptions(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	_, video := newReadyVideo(t, cfg)
+
+	ctx := context.Background()
+	oldKey := captionsKeyPrefix(video.ID) + "/en.vtt"
+	vtt := "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nCut\n\n00:00:06.000 --> 00:00:07.000\nKept\n"
+	if err := cfg.videoStore.Put(ctx, oldKey, strings.NewReader(vtt), captionMediaType); err != nil {
+		t.Fatalf("Couldn't store captions: %v", err)
+	}
+	if err := cfg.db.SetVideoCaption(video.ID, database.CaptionTrack{Language: "en", Label: "English", URL: cfg.videoStore.URL(oldKey)}); err != nil {
+		t.Fatalf("Couldn't add captions: %v", err)
+	}
+
+	enqueueTrim(t, cfg, video, 4*time.Second, 0)
+	runNextJob(t, cfg)
+
+	trimmed := getVideo(t, cfg, video.ID)
+	if trimmed.Status != database.VideoStatusReady || len(trimmed.Captions) != 1 {
+		t.Fatalf("Video after the trim has status %q and captions %+v", trimmed.Status, trimmed.Captions)
+	}
+	key, ok := storage.KeyFromURL(cfg.videoStore, trimmed.Captions[0].URL)
+	if !ok || key == oldKey {
+		t.Fatalf("Captions URL = %q, want a new track", trimmed.Captions[0].URL)
+	}
+	body, err := cfg.videoStore.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Couldn't get trimmed captions: %v", err)
+	}
+	defer body.Close()
+	got, _ := io.ReadAll(body)
+	if want := "WEBVTT\n\n00:00:02.000 --> 00:00:03.000\nKept\n"; string(got) != want {
+		t.Errorf("Trimmed captions = %q, want %q", got, want)
+	}
+	if _, err := cfg.videoStore.Head(ctx, oldKey); err == nil {
+		t.Error("Old captions weren't deleted")
+	}
+}
+
+func TestFailedTrimLeavesVideoReady(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	_, video := newReadyVideo(t, cfg)
+
+	// Starts after the fake video ends, which retrying won't fix
+	enqueueTrim(t, cfg, video, time.Hour, 0)
+	job := runNextJob(t, cfg)
+
+	if failed, err := cfg.db.GetJob(job.ID); err != nil || failed.Status != database.JobStatusFailed {
+		t.Fatalf("Job = %+v (%v), want it failed", failed, err)
+	}
+	settled := getVideo(t, cfg, video.ID)
+	if settled.Status != database.VideoStatusReady {
+		t.Errorf("Status = %q, want %q", settled.Status, database.VideoStatusReady)
+	}
+	if settled.StatusError == nil || !strings.Contains(*settled.StatusError, "trim starts") {
+		t.Errorf("Status error = %v, want why the trim failed", settled.StatusError)
+	}
+	if settled.VideoURL == nil || *settled.VideoURL != *video.VideoURL {
+		t.Errorf("Video URL = %v, want the untrimmed video still published", settled.VideoURL)
+	}
+}
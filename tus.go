@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	tusUploadTTL  = 24 * time.Hour
+)
+
+var errTusUploadNotFound = errors.New("upload not found")
+
+// tusUpload is the state of a resumable upload. It is stored as JSON next to
+// the partially written file, which is the source of truth for the offset.
+type tusUpload struct {
+	ID        string            `json:"id"`
+	VideoID   uuid.UUID         `json:"video_id"`
+	UserID    uuid.UUID         `json:"user_id"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+func (u tusUpload) expiresAt() time.Time {
+	return u.CreatedAt.Add(tusUploadTTL)
+}
+
+type tusStore struct {
+	dir   string
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newTusStore(dir string) (*tusStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating tus upload directory: %w", err)
+	}
+	return &tusStore{
+		dir:   dir,
+		locks: map[string]*sync.Mutex{},
+	}, nil
+}
+
+func (s *tusStore) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".info")
+}
+
+func (s *tusStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+func (s *tusStore) create(videoID, userID uuid.UUID, length int64, metadata map[string]string) (tusUpload, error) {
+	upload := tusUpload{
+		ID:        uuid.NewString(),
+		VideoID:   videoID,
+		UserID:    userID,
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	data, err := os.OpenFile(s.dataPath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return tusUpload{}, fmt.Errorf("error creating upload file: %w", err)
+	}
+	data.Close()
+
+	dat, err := json.Marshal(upload)
+	if err != nil {
+		return tusUpload{}, fmt.Errorf("error encoding upload info: %w", err)
+	}
+	if err := os.WriteFile(s.infoPath(upload.ID), dat, 0644); err != nil {
+		os.Remove(s.dataPath(upload.ID))
+		return tusUpload{}, fmt.Errorf("error writing upload info: %w", err)
+	}
+	return upload, nil
+}
+
+// get returns an upload and its offset. Expired uploads aren't found, removeExpired
+// cleans them up.
+func (s *tusStore) get(id string) (tusUpload, int64, error) {
+	upload, err := s.readInfo(id)
+	if err != nil {
+		return tusUpload{}, 0, err
+	}
+	if time.Now().After(upload.expiresAt()) {
+		return tusUpload{}, 0, errTusUploadNotFound
+	}
+
+	info, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return tusUpload{}, 0, errTusUploadNotFound
+		}
+		return tusUpload{}, 0, fmt.Errorf("error reading upload file: %w", err)
+	}
+	return upload, info.Size(), nil
+}
+
+func (s *tusStore) readInfo(id string) (tusUpload, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return tusUpload{}, errTusUploadNotFound
+	}
+
+	dat, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return tusUpload{}, errTusUploadNotFound
+		}
+		return tusUpload{}, fmt.Errorf("error reading upload info: %w", err)
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(dat, &upload); err != nil {
+		return tusUpload{}, fmt.Errorf("error decoding upload info: %w", err)
+	}
+	return upload, nil
+}
+
+// write appends at most upload.Length-offset bytes from r and returns the new offset.
+// Whatever made it to disk is kept even if r fails part way, so the client can resume.
+func (s *tusStore) write(upload tusUpload, offset int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.dataPath(upload.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return offset, fmt.Errorf("error opening upload file: %w", err)
+	}
+	defer f.Close()
+
+	n, copyErr := io.Copy(f, io.LimitReader(r, upload.Length-offset))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	return offset + n, copyErr
+}
+
+// lock returns false if another request is already writing to the upload.
+func (s *tusStore) lock(id string) (unlock func(), ok bool) {
+	s.mu.Lock()
+	l, exists := s.locks[id]
+	if !exists {
+		l = &sync.Mutex{}
+		s.locks[id] = l
+	}
+	s.mu.Unlock()
+
+	if !l.TryLock() {
+		return nil, false
+	}
+	return l.Unlock, true
+}
+
+func (s *tusStore) remove(id string) {
+	os.Remove(s.dataPath(id))
+	os.Remove(s.infoPath(id))
+
+	s.mu.Lock()
+	delete(s.locks, id)
+	s.mu.Unlock()
+}
+
+// removeExpired deletes the state of uploads that were abandoned before completion
+// and returns them.
+func (s *tusStore) removeExpired() []tusUpload {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+	expired := []tusUpload{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if !ok {
+			continue
+		}
+		upload, err := s.readInfo(id)
+		if err != nil || !time.Now().After(upload.expiresAt()) {
+			continue
+		}
+		// Still being written to, which the next run will catch
+		unlock, ok := s.lock(id)
+		if !ok {
+			continue
+		}
+		s.remove(id)
+		unlock()
+		expired = append(expired, upload)
+	}
+	return expired
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// key/value pairs with base64 encoded values.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %q: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
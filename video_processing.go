@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	videoMediaType   = "video/mp4"
+	videoUploadLimit = 1 << 30 // 1 GB
+)
+
+// uploadVideoTypes are the containers we accept uploads in, with the extension
+// their raw uploads are staged under. Everything is published as MP4.
+var uploadVideoTypes = map[string]string{
+	"video/mp4":        ".mp4",
+	"video/quicktime":  ".mov",
+	"video/webm":       ".webm",
+	"video/x-matroska": ".mkv",
+}
+
+func isUploadVideoType(mediaType string) bool {
+	_, ok := uploadVideoTypes[mediaType]
+	return ok
+}
+
+const jobKindProcessVideo = "process_video"
+
+var errUnsupportedVideoType = errors.New("unsupported video type")
+
+type processVideoPayload struct {
+	// Raw upload in the video store, under incomingKeyPrefix, or the video's
+	// original when it's reprocessed
+	SourceKey string `json:"source_key"`
+}
+
+// uploadMediaType recovers the media type of a raw upload from its key, which
+// incomingObjectKey gave the extension of its type.
+func uploadMediaType(key string) string {
+	for mediaType, ext := range uploadVideoTypes {
+		if path.Ext(key) == ext {
+			return mediaType
+		}
+	}
+	return videoMediaType
+}
+
+// incomingKeyPrefix is where raw uploads for a video wait before processing.
+func incomingKeyPrefix(videoID uuid.UUID) string {
+	return path.Join("incoming", videoID.String())
+}
+
+// incomingObjectKey returns a fresh key for a raw upload of the given media type.
+func incomingObjectKey(videoID uuid.UUID, mediaType string) (string, error) {
+	objBaseKey, err := getAssetPath(mediaType)
+	if err != nil {
+		return "", fmt.Errorf("error creating object key: %w", err)
+	}
+	return path.Join(incomingKeyPrefix(videoID), objBaseKey), nil
+}
+
+// stageVideoUpload stores a raw upload where the processing job can pick it up
+// and returns its key.
+func (cfg *apiConfig) stageVideoUpload(ctx context.Context, videoID uuid.UUID, body io.Reader, mediaType string) (string, error) {
+	objKey, err := incomingObjectKey(videoID, mediaType)
+	if err != nil {
+		return "", err
+	}
+
+	if err := cfg.videoStore.Put(ctx, objKey, body, mediaType); err != nil {
+		return "", fmt.Errorf("error staging upload: %w", err)
+	}
+	return objKey, nil
+}
+
+// deleteStagedUpload removes a raw upload that won't be processed after all.
+// Failures are retried in the background like other deletions.
+func (cfg *apiConfig) deleteStagedUpload(ctx context.Context, sourceKey string) {
+	deletions, err := cfg.db.QueueObjectDeletions([]database.ObjectRef{{Store: videoStoreName, Key: sourceKey}})
+	if err != nil {
+		log.Printf("Couldn't queue deletion of upload %s: %v", sourceKey, err)
+		return
+	}
+	cfg.runObjectDeletions(ctx, deletions)
+}
+
+// beginVideoUpload marks a video as receiving a new upload. It fails with
+// database.ErrInvalidStatusTransition while the previous upload is still processing.
+func (cfg *apiConfig) beginVideoUpload(videoID uuid.UUID) error {
+	return cfg.db.SetVideoStatus(videoID, database.VideoStatusUploading, "")
+}
+
+// abandonVideoUpload puts a video back into the status it had before an upload
+// that never finished. previous is the video as it was before beginVideoUpload.
+func (cfg *apiConfig) abandonVideoUpload(previous database.Video) {
+	status := previous.Status
+	statusErr := ""
+	switch {
+	case status == database.VideoStatusFailed && previous.StatusError != nil:
+		statusErr = *previous.StatusError
+	case status == database.VideoStatusDraft || status == database.VideoStatusReady:
+	case previous.VideoURL != nil:
+		status = database.VideoStatusReady
+	default:
+		status = database.VideoStatusDraft
+	}
+	if err := cfg.db.SetVideoStatus(previous.ID, status, statusErr); err != nil {
+		log.Printf("Couldn't reset status of video %s: %v", previous.ID, err)
+	}
+}
+
+// settleVideo takes a video out of processing after its processing was cancelled
+// or failed for good, recording why: back to ready if an earlier upload, or the
+// version a trim or reprocess started from, is still published, otherwise to failed.
+func (cfg *apiConfig) settleVideo(videoID uuid.UUID, cause error) {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		log.Printf("Couldn't get video %s: %v", videoID, err)
+		return
+	}
+	// The video was deleted, which may be why its processing was cancelled
+	if video.ID == uuid.Nil {
+		return
+	}
+	status := database.VideoStatusFailed
+	if video.VideoURL != nil {
+		status = database.VideoStatusReady
+	}
+	if err := cfg.db.SetVideoStatus(videoID, status, cause.Error()); err != nil {
+		log.Printf("Couldn't reset status of video %s: %v", videoID, err)
+	}
+}
+
+// enqueueVideoProcessing queues the raw upload at sourceKey for background
+// processing and returns the video with its updated status.
+func (cfg *apiConfig) enqueueVideoProcessing(videoID uuid.UUID, sourceKey string) (database.Video, error) {
+	return cfg.enqueueVideoJob(videoID, jobKindProcessVideo, processVideoPayload{SourceKey: sourceKey})
+}
+
+// enqueueVideoJob moves a video to processing and queues a job of kind for it,
+// leaving the video as it was if either fails.
+func (cfg *apiConfig) enqueueVideoJob(videoID uuid.UUID, kind string, payload any) (database.Video, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("error encoding job payload: %w", err)
+	}
+
+	_, err = cfg.db.EnqueueVideoJob(database.CreateJobParams{
+		Kind:        kind,
+		VideoID:     videoID,
+		Payload:     string(data),
+		MaxAttempts: jobMaxAttempts,
+	})
+	if err != nil {
+		return database.Video{}, fmt.Errorf("error queueing %s: %w", kind, err)
+	}
+
+	return cfg.db.GetVideo(videoID)
+}
+
+func (cfg *apiConfig) handleProcessVideoJob(ctx context.Context, job database.Job) error {
+	var payload processVideoPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return permanent(fmt.Errorf("error decoding job payload: %w", err))
+	}
+
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return fmt.Errorf("error getting video: %w", err)
+	}
+	if video.ID == uuid.Nil {
+		// Deleted while queued, the upload has nowhere to go
+		return cfg.videoStore.Delete(ctx, payload.SourceKey)
+	}
+	// Shares ffmpeg fairly with the owner's other videos and everyone else's
+	ctx = media.WithOwner(ctx, video.UserID.String())
+
+	if err := cfg.db.SetVideoStatus(video.ID, database.VideoStatusProcessing, ""); err != nil {
+		return fmt.Errorf("error updating video status: %w", err)
+	}
+
+	tempFile, err := os.CreateTemp("", tempFilePrefix)
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	if err := cfg.downloadObject(ctx, payload.SourceKey, tempFile); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return permanent(err)
+		}
+		return err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("error writing temp file: %w", err)
+	}
+
+	reprocessing := video.OriginalKey != nil && *video.OriginalKey == payload.SourceKey
+
+	// Presigned uploads reach us without having been looked at
+	probe, err := cfg.validateUploadedVideo(ctx, tempFile.Name())
+	if err != nil {
+		if errors.Is(err, errUnsupportedVideoType) {
+			if !reprocessing {
+				cfg.videoStore.Delete(ctx, payload.SourceKey)
+			}
+			return permanent(err)
+		}
+		return err
+	}
+
+	watermark, removeWatermark, err := cfg.videoWatermark(ctx, video.UserID)
+	if err != nil {
+		return err
+	}
+	defer removeWatermark()
+
+	progress := cfg.newProcessingProgress(video.ID, cfg.processingSteps(probe))
+	videoPath := tempFile.Name()
+	if needsTranscode(probe) {
+		videoPath, err = cfg.transcodeToMP4(ctx, tempFile.Name(), probe, progress.step("transcoding", probe.DurationSeconds))
+		if err != nil {
+			return err
+		}
+		defer os.Remove(videoPath)
+	}
+
+	outputs, err := cfg.processVideoFile(ctx, videoPath, probe, watermark, progress)
+	if err != nil {
+		return err
+	}
+
+	sourceKey := ""
+	outputs.OriginalKey = video.OriginalKey
+	if !reprocessing {
+		sourceKey = payload.SourceKey
+		originalKey, err := cfg.storeOriginal(ctx, video.ID, sourceKey)
+		if err != nil {
+			return err
+		}
+		outputs.OriginalKey = &originalKey
+	}
+
+	if err := cfg.db.SetVideoOutputs(video.ID, outputs); err != nil {
+		return fmt.Errorf("error updating video: %w", err)
+	}
+	if video.ThumbnailURL == nil {
+		// A missing thumbnail isn't worth failing the whole upload over
+		if err := cfg.generateThumbnail(ctx, video, videoPath); err != nil {
+			log.Printf("Couldn't generate thumbnail for video %s: %v", video.ID, err)
+		}
+	}
+
+	if err := cfg.db.SetVideoStatus(video.ID, database.VideoStatusReady, ""); err != nil {
+		return fmt.Errorf("error updating video status: %w", err)
+	}
+
+	cfg.replaceVideoObjects(ctx, video, outputs, sourceKey)
+	return nil
+}
+
+// replaceVideoObjects cleans up after a successful processing run: the raw upload,
+// if there was one, whatever the video pointed at before and its previous original,
+// if outputs were made from another one, are no longer needed.
+func (cfg *apiConfig) replaceVideoObjects(ctx context.Context, previous database.Video, outputs database.VideoOutputs, sourceKey string) {
+	refs := []database.ObjectRef{}
+	if sourceKey != "" {
+		refs = append(refs, database.ObjectRef{Store: videoStoreName, Key: sourceKey})
+	}
+	if previous.OriginalKey != nil && (outputs.OriginalKey == nil || *outputs.OriginalKey != *previous.OriginalKey) {
+		refs = append(refs, database.ObjectRef{Store: videoStoreName, Key: *previous.OriginalKey})
+	}
+	if previous.VideoURL != nil {
+		if key, ok := storage.KeyFromURL(cfg.videoStore, *previous.VideoURL); ok {
+			refs = append(refs,
+				database.ObjectRef{Store: videoStoreName, Key: key},
+				database.ObjectRef{Store: videoStoreName, Key: derivedKeyPrefix(key), IsPrefix: true},
+			)
+		}
+	}
+
+	deletions, err := cfg.db.QueueObjectDeletions(refs)
+	if err != nil {
+		// The garbage collector will find them instead
+		log.Printf("Couldn't queue replaced objects of video %s for deletion: %v", previous.ID, err)
+		return
+	}
+	cfg.runObjectDeletions(ctx, deletions)
+}
+
+// processingSteps counts the ffmpeg runs processing an upload takes, for progress reporting.
+func (cfg *apiConfig) processingSteps(probe media.Probe) int {
+	steps := 1 // fast start
+	if probe.HasAudio {
+		steps++ // loudness measurement
+		if _, ok := audioRenditionExts[cfg.audioRendition]; ok {
+			steps++
+		}
+	}
+	if needsTranscode(probe) {
+		steps++
+	}
+	if cfg.hlsEnabled || cfg.dashEnabled {
+		steps += len(ladderFor(probe))
+	}
+	return steps
+}
+
+// processVideoFile runs an uploaded MP4 at filePath through fast start processing,
+// loudness normalization and watermarking, stores it in the video store along with any streaming
+// and audio renditions and previews and returns their URLs. source is what the caller's probe
+// found in filePath, or in the file filePath was transcoded or cut from, with filePath's duration.
+func (cfg *apiConfig) processVideoFile(ctx context.Context, filePath string, source media.Probe, watermark *media.Watermark, progress *processingProgress) (database.VideoOutputs, error) {
+	loudness, err := cfg.measureLoudness(ctx, filePath, source, progress.step("measuring loudness", source.DurationSeconds))
+	if err != nil {
+		return database.VideoOutputs{}, err
+	}
+
+	processedFilePath, err := cfg.optimizeForPlayback(ctx, filePath, loudness, watermark, progress.step("optimizing", source.DurationSeconds))
+	if err != nil {
+		return database.VideoOutputs{}, fmt.Errorf("error processing video for fast start: %w", err)
+	}
+	defer os.Remove(processedFilePath)
+
+	processedFile, err := os.Open(processedFilePath)
+	if err != nil {
+		return database.VideoOutputs{}, fmt.Errorf("error reading processed file: %w", err)
+	}
+	defer processedFile.Close()
+
+	probe, err := cfg.media.Probe(ctx, processedFilePath)
+	if err != nil {
+		return database.VideoOutputs{}, fmt.Errorf("error probing video: %w", err)
+	}
+	aspectRatio := calcAspectRatio(probe.DisplaySize())
+	objPrefix := getObjectKeyPrefix(aspectRatio)
+
+	objBaseKey, err := getAssetPath(videoMediaType)
+	if err != nil {
+		return database.VideoOutputs{}, fmt.Errorf("error creating object key: %w", err)
+	}
+	objKey := path.Join(objPrefix, objBaseKey)
+
+	if err := cfg.videoStore.Put(ctx, objKey, processedFile, videoMediaType); err != nil {
+		return database.VideoOutputs{}, fmt.Errorf("error uploading file to storage: %w", err)
+	}
+	outputs := database.VideoOutputs{
+		VideoURL:    cfg.videoStore.URL(objKey),
+		AspectRatio: aspectRatio,
+		Media:       mediaInfo(probe, loudness),
+	}
+
+	if err := cfg.publishStreams(ctx, processedFilePath, objKey, probe, &outputs, progress); err != nil {
+		return database.VideoOutputs{}, err
+	}
+	if err := cfg.publishAudio(ctx, processedFilePath, objKey, probe, &outputs, progress); err != nil {
+		return database.VideoOutputs{}, err
+	}
+	if err := cfg.publishPreviews(ctx, processedFilePath, objKey, probe, &outputs); err != nil {
+		return database.VideoOutputs{}, err
+	}
+	return outputs, nil
+}
+
+func (cfg *apiConfig) downloadObject(ctx context.Context, key string, dst *os.File) error {
+	body, err := cfg.videoStore.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if _, err := io.Copy(dst, body); err != nil {
+		return fmt.Errorf("error downloading %s: %w", key, err)
+	}
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error resetting file pointer: %w", err)
+	}
+	return nil
+}
+
+func mediaInfo(probe media.Probe, loudness *media.Loudness) *database.MediaInfo {
+	width, height := probe.DisplaySize()
+	info := &database.MediaInfo{
+		DurationSeconds: probe.DurationSeconds,
+		Width:           width,
+		Height:          height,
+		VideoCodec:      probe.VideoCodec,
+		AudioChannels:   probe.AudioChannels,
+		BitRate:         probe.BitRate,
+		FrameRate:       probe.FrameRate,
+		FormatName:      probe.FormatName,
+		ProbedAt:        time.Now().UTC(),
+	}
+	if probe.HasAudio {
+		audioCodec := probe.AudioCodec
+		info.AudioCodec = &audioCodec
+	}
+	if loudness != nil && !math.IsInf(loudness.Integrated, 0) {
+		integrated := loudness.Integrated
+		info.IntegratedLoudness = &integrated
+	}
+	return info
+}
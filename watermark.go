@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultWatermarkPosition = "bottom-right"
+	defaultWatermarkOpacity  = 0.8
+	defaultWatermarkScale    = 0.15
+	watermarkUploadLimit     = 2 << 20 // 2 MB
+)
+
+// watermarksKeyPrefix is where a user's watermark images are stored in the video store.
+func watermarksKeyPrefix(userID uuid.UUID) string {
+	return path.Join("watermarks", userID.String())
+}
+
+// originalsKeyPrefix is where the upload a video was made from is kept. Like
+// incoming uploads, originals are never served.
+func originalsKeyPrefix(videoID uuid.UUID) string {
+	return path.Join("originals", videoID.String())
+}
+
+func validateWatermark(position string, opacity, scale float64) error {
+	if !slices.Contains(media.WatermarkPositions, position) {
+		return fmt.Errorf("position must be one of %v", media.WatermarkPositions)
+	}
+	if opacity <= 0 || opacity > 1 {
+		return errors.New("opacity must be above 0 and at most 1")
+	}
+	if scale <= 0 || scale > 1 {
+		return errors.New("scale must be above 0 and at most 1")
+	}
+	return nil
+}
+
+// videoWatermark returns the watermark for a user's videos: their own if they set
+// one, otherwise the global one, if any. The returned func removes any temp files.
+func (cfg *apiConfig) videoWatermark(ctx context.Context, userID uuid.UUID) (*media.Watermark, func(), error) {
+	noop := func() {}
+	settings, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		return nil, noop, fmt.Errorf("error getting watermark: %w", err)
+	}
+	if settings == nil {
+		return cfg.watermark, noop, nil
+	}
+
+	key, ok := storage.KeyFromURL(cfg.videoStore, settings.ImageURL)
+	if !ok {
+		return nil, noop, permanent(fmt.Errorf("watermark image %s isn't in the video store", settings.ImageURL))
+	}
+	imageFile, err := os.CreateTemp("", tempFilePrefix+"-watermark-*"+path.Ext(key))
+	if err != nil {
+		return nil, noop, fmt.Errorf("error creating temp file: %w", err)
+	}
+	cleanup := func() { os.Remove(imageFile.Name()) }
+	defer imageFile.Close()
+
+	if err := cfg.downloadObject(ctx, key, imageFile); err != nil {
+		cleanup()
+		return nil, noop, fmt.Errorf("error downloading watermark: %w", err)
+	}
+	return &media.Watermark{
+		ImagePath: imageFile.Name(),
+		Position:  settings.Position,
+		Opacity:   settings.Opacity,
+		Scale:     settings.Scale,
+	}, cleanup, nil
+}
+
+// originalObjectKey returns a fresh key for a video's original of the given media type.
+func originalObjectKey(videoID uuid.UUID, mediaType string) (string, error) {
+	assetPath, err := getAssetPath(mediaType)
+	if err != nil {
+		return "", fmt.Errorf("error creating object key: %w", err)
+	}
+	return path.Join(originalsKeyPrefix(videoID), assetPath), nil
+}
+
+// storeOriginal keeps the raw upload at sourceKey privately, so the video can be
+// processed again later, and returns its key. The upload is copied within the
+// video store rather than uploaded again.
+func (cfg *apiConfig) storeOriginal(ctx context.Context, videoID uuid.UUID, sourceKey string) (string, error) {
+	key, err := originalObjectKey(videoID, uploadMediaType(sourceKey))
+	if err != nil {
+		return "", err
+	}
+	if err := cfg.videoStore.Copy(ctx, sourceKey, key); err != nil {
+		return "", fmt.Errorf("error storing original: %w", err)
+	}
+	return key, nil
+}
+
+// watermarkRefs lists the images of every user's watermark.
+func (cfg *apiConfig) watermarkRefs() ([]database.ObjectRef, error) {
+	watermarks, err := cfg.db.GetWatermarks()
+	if err != nil {
+		return nil, err
+	}
+	refs := []database.ObjectRef{}
+	for _, watermark := range watermarks {
+		if key, ok := storage.KeyFromURL(cfg.videoStore, watermark.ImageURL); ok {
+			refs = append(refs, database.ObjectRef{Store: videoStoreName, Key: key})
+		}
+	}
+	return refs, nil
+}